@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Fault is the side of a proxied connection an error is attributed to,
+// so that callers can tell a failing upstream from a downstream which went away.
+type Fault int
+
+const (
+	// FaultNone indicates there was no error, or the connection was closed normally
+	FaultNone Fault = iota
+	// FaultDownstream indicates the downstream aborted the connection
+	FaultDownstream
+	// FaultUpstream indicates the upstream refused, reset, or timed out the connection
+	FaultUpstream
+	// FaultUnknown indicates an error which can't be attributed to either side,
+	// such as a panic while proxying
+	FaultUnknown
+)
+
+// directionError records if an error returned by readWriteLoop came from
+// reading or writing, so that it can be attributed to a side of the connection.
+type directionError struct {
+	read bool
+	err  error
+}
+
+func (e *directionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *directionError) Unwrap() error {
+	return e.err
+}
+
+// ClassifyDial returns the Fault of an error from dialing an upstream.
+func ClassifyDial(err error) Fault {
+	if err == nil {
+		return FaultNone
+	}
+	if isConnectionFailure(err) {
+		return FaultUpstream
+	}
+	return FaultUnknown
+}
+
+// ClassifyToUp returns the Fault of a toUp error returned by Bidirectional,
+// for which bytes are read from down and written to up.
+func ClassifyToUp(err error) Fault {
+	return classify(err, FaultDownstream, FaultUpstream)
+}
+
+// ClassifyToDown returns the Fault of a toDown error returned by Bidirectional,
+// for which bytes are read from up and written to down.
+func ClassifyToDown(err error) Fault {
+	return classify(err, FaultUpstream, FaultDownstream)
+}
+
+// classify attributes a connection failure to readFault or writeFault,
+// depending on whether it occurred while reading or writing.
+func classify(err error, readFault, writeFault Fault) Fault {
+	if err == nil || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return FaultNone
+	}
+	var dirErr *directionError
+	if !errors.As(err, &dirErr) || !isConnectionFailure(err) {
+		return FaultUnknown
+	}
+	if dirErr.read {
+		return readFault
+	}
+	return writeFault
+}
+
+// isConnectionFailure checks if err is a refused, reset, or timed out connection
+func isConnectionFailure(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// errReader returns err on every call to Read
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// errWriter returns err on every call to Write, and closes without error
+type errWriter struct {
+	err error
+}
+
+func (w errWriter) Write([]byte) (int, error) { return 0, w.err }
+
+func (errWriter) Close() error { return nil }
+
+func TestClassify(t *testing.T) {
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	broken := &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}
+	timeout := &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	other := errors.New("other")
+
+	tests := []struct {
+		name           string
+		r              io.Reader
+		w              io.WriteCloser
+		expectedToUp   Fault
+		expectedToDown Fault
+	}{
+		{
+			name:           "reader ends normally",
+			r:              strings.NewReader("bytes"),
+			w:              errWriter{},
+			expectedToUp:   FaultNone,
+			expectedToDown: FaultNone,
+		},
+		{
+			name:           "reader closed",
+			r:              errReader{err: net.ErrClosed},
+			w:              errWriter{},
+			expectedToUp:   FaultNone,
+			expectedToDown: FaultNone,
+		},
+		{
+			name:           "reader reset",
+			r:              errReader{err: reset},
+			w:              errWriter{},
+			expectedToUp:   FaultDownstream,
+			expectedToDown: FaultUpstream,
+		},
+		{
+			name:           "reader timed out",
+			r:              errReader{err: timeout},
+			w:              errWriter{},
+			expectedToUp:   FaultDownstream,
+			expectedToDown: FaultUpstream,
+		},
+		{
+			name:           "writer broken",
+			r:              strings.NewReader("bytes"),
+			w:              errWriter{err: broken},
+			expectedToUp:   FaultUpstream,
+			expectedToDown: FaultDownstream,
+		},
+		{
+			name:           "reader fails otherwise",
+			r:              errReader{err: other},
+			w:              errWriter{},
+			expectedToUp:   FaultUnknown,
+			expectedToDown: FaultUnknown,
+		},
+		{
+			name:           "reader panics",
+			r:              panicReader{},
+			w:              errWriter{},
+			expectedToUp:   FaultUnknown,
+			expectedToDown: FaultUnknown,
+		},
+	}
+
+	for _, test := range tests {
+		err, _ := readWriteLoop(test.r, test.w, nil)
+		if fault := ClassifyToUp(err); fault != test.expectedToUp {
+			t.Errorf("%v: expected ClassifyToUp %v, got %v (%v)", test.name, test.expectedToUp, fault, err)
+		}
+		if fault := ClassifyToDown(err); fault != test.expectedToDown {
+			t.Errorf("%v: expected ClassifyToDown %v, got %v (%v)", test.name, test.expectedToDown, fault, err)
+		}
+	}
+}
+
+func TestClassifyDial(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	_, err = net.Dial("tcp", addr)
+	if fault := ClassifyDial(err); fault != FaultUpstream {
+		t.Errorf("expected refused dial to be %v, got %v (%v)", FaultUpstream, fault, err)
+	}
+	if fault := ClassifyDial(nil); fault != FaultNone {
+		t.Errorf("expected successful dial to be %v, got %v", FaultNone, fault)
+	}
+	if fault := ClassifyDial(errors.New("other")); fault != FaultUnknown {
+		t.Errorf("expected other dial error to be %v, got %v", FaultUnknown, fault)
+	}
+}
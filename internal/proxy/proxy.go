@@ -2,18 +2,30 @@ package proxy
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"sync"
 )
 
+var errorPanic = errors.New("Panic While Proxying")
+
 // Bidirectional is used to operate a two-way proxy.
 // There is a go routine per direction, calling blocking reads,
 // and writing to the other side when bytes are returned.
 // When a call to read returns an error, it will attempt to close the writer,
 // ensuring that a single connection closing results in both closing.
 // Nil is returned instead of EOF errors, as they are used to indicate a closed connection.
+// A panic while reading or writing is recovered and returned as an error for that direction,
+// closing its writer just as any other error would.
 func Bidirectional(down, up io.ReadWriteCloser) (toUp, toUpClose, toDown, toDownClose error) {
+	return BidirectionalCounted(down, up, nil, nil)
+}
+
+// BidirectionalCounted is Bidirectional, but reports the bytes written in each direction.
+// countToUp and countToDown are called after each write to up and down respectively,
+// from the goroutine handling that direction. Either may be nil.
+func BidirectionalCounted(down, up io.ReadWriteCloser, countToUp, countToDown func(n int)) (toUp, toUpClose, toDown, toDownClose error) {
 
 	/*
 		This sync code can appear somewhat confusing at first,
@@ -49,11 +61,11 @@ func Bidirectional(down, up io.ReadWriteCloser) (toUp, toUpClose, toDown, toDown
 	var toUpErr, toUpCloseErr, toDownErr, toDownCloseErr error
 
 	go func() {
-		toUpErr, toUpCloseErr = readWriteLoop(down, up)
+		toUpErr, toUpCloseErr = readWriteLoop(down, up, countToUp)
 		wg.Done()
 	}()
 	go func() {
-		toDownErr, toDownCloseErr = readWriteLoop(up, down)
+		toDownErr, toDownCloseErr = readWriteLoop(up, down, countToDown)
 		wg.Done()
 	}()
 
@@ -65,7 +77,26 @@ func Bidirectional(down, up io.ReadWriteCloser) (toUp, toUpClose, toDown, toDown
 // readWriteLoop is one half of a bidirectional proxy,
 // using blocking reads to pull data and blocking writes to push data.
 // errors on either writing or reading result in the function returning
-func readWriteLoop(r io.Reader, w io.WriteCloser) (writeErr, closeError error) {
+// If count is non-nil it is called with the number of bytes written after each write.
+func readWriteLoop(r io.Reader, w io.WriteCloser, count func(n int)) (writeErr, closeError error) {
+	// closed records that Close has been attempted, so that a panic
+	// from Close itself does not lead to Close being called again.
+	closed := false
+	closeWriter := func() error {
+		closed = true
+		return w.Close()
+	}
+
+	defer func() {
+		// a panic in one connection's proxy must not take down the whole process
+		if p := recover(); p != nil {
+			writeErr = fmt.Errorf("%w: %v", errorPanic, p)
+			if !closed {
+				closeError = closeRecovered(w)
+			}
+		}
+	}()
+
 	// It may be wise to make a pool of buffers at some point.
 	buff := make([]byte, 0xffff)
 
@@ -81,17 +112,31 @@ func readWriteLoop(r io.Reader, w io.WriteCloser) (writeErr, closeError error) {
 			// Write returns an error if it doesn't write n bytes.
 			// for now we are assuming an error from write indicates
 			// that we can no longer write and should exit.
-			_, err = w.Write(b)
+			var written int
+			written, err = w.Write(b)
+			if count != nil && written > 0 {
+				count(written)
+			}
 			if err != nil {
-				return err, w.Close()
+				return &directionError{err: err}, closeWriter()
 			}
 		}
 
 		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
-			return nil, w.Close()
+			return nil, closeWriter()
 		}
 		if err != nil {
-			return err, w.Close()
+			return &directionError{read: true, err: err}, closeWriter()
 		}
 	}
 }
+
+// closeRecovered closes w, returning a panic from Close as an error
+func closeRecovered(w io.Closer) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%w: %v", errorPanic, p)
+		}
+	}()
+	return w.Close()
+}
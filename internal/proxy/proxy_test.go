@@ -5,6 +5,7 @@ import (
 	"io"
 	"reflect"
 	"sync"
+	"strings"
 	"testing"
 )
 
@@ -417,3 +418,144 @@ func TestBidirectional(t *testing.T) {
 		})
 	}
 }
+
+func TestBidirectionalCounted(t *testing.T) {
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+
+	var toUpBytes, toDownBytes int
+	countToUp := func(n int) { toUpBytes += n }
+	countToDown := func(n int) { toDownBytes += n }
+
+	downRemote, downLocal := newBidirectionalPipe()
+	upLocal, upRemote := newBidirectionalPipe()
+
+	// Pass the local ends to the proxy
+	go func() {
+		BidirectionalCounted(downLocal, upLocal, countToUp, countToDown)
+		wg.Done()
+	}()
+
+	toUpData := []byte("this should pass through the proxy - 1")
+	toDownData := []byte("this should pass through the proxy - 22")
+
+	// Write to down, read from up
+	if _, err := downRemote.Write(toUpData); err != nil {
+		t.Errorf("got error while writing to down: %v", err)
+	}
+	if _, err := io.ReadFull(upRemote, make([]byte, len(toUpData))); err != nil {
+		t.Errorf("got error while reading from up: %v", err)
+	}
+
+	// Write to up, read from down
+	if _, err := upRemote.Write(toDownData); err != nil {
+		t.Errorf("got error while writing to up: %v", err)
+	}
+	if _, err := io.ReadFull(downRemote, make([]byte, len(toDownData))); err != nil {
+		t.Errorf("got error while reading from down: %v", err)
+	}
+
+	// Close both, and wait for the proxy to return
+	downRemote.Close()
+	upRemote.Close()
+	wg.Wait()
+
+	if toUpBytes != len(toUpData) {
+		t.Errorf("expected %v bytes counted to up, got %v", len(toUpData), toUpBytes)
+	}
+	if toDownBytes != len(toDownData) {
+		t.Errorf("expected %v bytes counted to down, got %v", len(toDownData), toDownBytes)
+	}
+}
+
+// panicReader panics on every call to Read
+type panicReader struct{}
+
+func (panicReader) Read([]byte) (int, error) {
+	panic("panicReader")
+}
+
+func TestBidirectionalRecoversPanic(t *testing.T) {
+	downRemote, downLocal := newBidirectionalPipe()
+	upLocal, upRemote := newBidirectionalPipe()
+
+	// reads from down panic
+	panickingDown := bidirectionalPipeEnd{
+		Reader:      panicReader{},
+		WriteCloser: downLocal.WriteCloser,
+	}
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	var toUpErr, toDownErr error
+	go func() {
+		toUpErr, _, toDownErr, _ = Bidirectional(panickingDown, upLocal)
+		wg.Done()
+	}()
+
+	// The panic closes up
+	n, err := upRemote.Read(make([]byte, 1))
+	if n != 0 {
+		t.Errorf("read bytes from up, should have been closed")
+	}
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("didn't get EOF from up, got %v", err)
+	}
+
+	// Close up, so the other direction ends as well
+	err = upRemote.Close()
+	if err != nil {
+		t.Errorf("failed to close up side of proxy.Bidirectional")
+	}
+	_, err = downRemote.Read(make([]byte, 1))
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("didn't get EOF from down, got %v", err)
+	}
+	wg.Wait()
+
+	if !errors.Is(toUpErr, errorPanic) {
+		t.Errorf("expected toUpErr %v, got %v", errorPanic, toUpErr)
+	}
+	if toDownErr != nil {
+		t.Errorf("unexpected toDownErr: %v", toDownErr)
+	}
+}
+
+// panicCloser discards writes and panics on every call to Close
+type panicCloser struct {
+	closes int
+}
+
+func (*panicCloser) Write(b []byte) (int, error) { return len(b), nil }
+
+func (c *panicCloser) Close() error {
+	c.closes++
+	panic("panicCloser")
+}
+
+func TestReadWriteLoopRecoversPanicFromClose(t *testing.T) {
+	tests := []struct {
+		name string
+		r    io.Reader
+	}{
+		{
+			name: "panic from closing after the reader ends",
+			r:    strings.NewReader("bytes"),
+		},
+		{
+			name: "panic from closing after a panic from reading",
+			r:    panicReader{},
+		},
+	}
+
+	for _, test := range tests {
+		w := &panicCloser{}
+		writeErr, closeErr := readWriteLoop(test.r, w, nil)
+		if w.closes != 1 {
+			t.Errorf("%v: expected Close to be called once, got %v", test.name, w.closes)
+		}
+		if !errors.Is(writeErr, errorPanic) && !errors.Is(closeErr, errorPanic) {
+			t.Errorf("%v: expected an error %v, got %v and %v", test.name, errorPanic, writeErr, closeErr)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package tracker
+
+import (
+	"sync"
+	"time"
+)
+
+// DownstreamByteQuotas limits the bytes proxied per downstream
+// over a rolling window, based on a unique string identifier.
+// Callers report the bytes proxied for a downstream, and are told if
+// the downstream is within its quota, so that they can refuse new connections
+// or close existing ones once it is exceeded.
+// The rolling window is approximated as it is by DownstreamQuotas.
+// DownstreamByteQuotas is safe for concurrent use.
+type DownstreamByteQuotas struct {
+	// mu protects the resources of DownstreamByteQuotas
+	mu sync.Mutex
+
+	// windows is a map of downstreamID to a quotaWindow of bytes
+	windows map[string]*quotaWindow
+
+	// clock provides the time used to advance windows
+	clock Clock
+}
+
+// NewDownstreamByteQuotas initializes and returns a DownstreamByteQuotas
+func NewDownstreamByteQuotas() *DownstreamByteQuotas {
+	return &DownstreamByteQuotas{
+		windows: map[string]*quotaWindow{},
+		clock:   systemClock{},
+	}
+}
+
+// SetClock replaces the Clock used by DownstreamByteQuotas,
+// and must be called before DownstreamByteQuotas is used.
+func (t *DownstreamByteQuotas) SetClock(clock Clock) {
+	t.clock = clock
+}
+
+// Allow checks if a downstreamID's bytes over the last window are below the provided max,
+// so that a new connection for the downstream may be started.
+// A window must be positive, otherwise the connection is not allowed.
+func (t *DownstreamByteQuotas) Allow(downstreamID string, max uint64, window time.Duration) bool {
+	if window <= 0 {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	w := windowFor(t.windows, downstreamID, window, now)
+	return w.estimate(now) < float64(max)
+}
+
+// RecordBytes adds n bytes proxied for a downstreamID to its current window.
+// If the downstream has no history, or the window has changed, a new count will be started.
+// A window must be positive, otherwise the bytes are not recorded.
+// The return indicates if the downstream is still within max,
+// connections for a downstream which is not should be closed.
+func (t *DownstreamByteQuotas) RecordBytes(downstreamID string, n, max uint64, window time.Duration) bool {
+	if window <= 0 {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	w := windowFor(t.windows, downstreamID, window, now)
+	w.count += n
+	w.last = now
+	return w.estimate(now) <= float64(max)
+}
+
+// Usage returns the estimated bytes proxied for a downstreamID over its last window.
+// A downstream with no history has a Usage of 0.
+func (t *DownstreamByteQuotas) Usage(downstreamID string) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	w, ok := t.windows[downstreamID]
+	if !ok {
+		return 0
+	}
+	now := t.clock.Now()
+	w.advance(now)
+	return uint64(w.estimate(now))
+}
+
+// RemoveIdle stops tracking downstreams which have not recorded bytes for at least ttl
+// and whose windows no longer hold any bytes, so no quota is lost.
+// RemoveIdle is intended to be called periodically, so that downstreams
+// which are no longer connecting don't accumulate forever.
+func (t *DownstreamByteQuotas) RemoveIdle(ttl time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	removeIdleWindows(t.windows, t.clock.Now(), ttl)
+}
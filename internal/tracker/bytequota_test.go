@@ -0,0 +1,99 @@
+package tracker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDownstreamByteQuotas(t *testing.T) {
+	downstream1 := "downstream1"
+	downstream2 := "downstream2"
+
+	tests := []struct {
+		name string
+		op   func(*DownstreamByteQuotas, *FakeClock)
+	}{
+		{
+			name: "allow bytes up to the quota",
+			op: func(tracker *DownstreamByteQuotas, clock *FakeClock) {
+				if !tracker.Allow(downstream1, 100, time.Hour) {
+					t.Errorf("expected downstream without history to be allowed\n")
+				}
+				if !tracker.RecordBytes(downstream1, 60, 100, time.Hour) {
+					t.Errorf("expected bytes beneath quota to be within it\n")
+				}
+				if !tracker.RecordBytes(downstream1, 40, 100, time.Hour) {
+					t.Errorf("expected bytes reaching quota to be within it\n")
+				}
+				if tracker.Allow(downstream1, 100, time.Hour) {
+					t.Errorf("expected new connection at quota to be denied\n")
+				}
+				if tracker.RecordBytes(downstream1, 1, 100, time.Hour) {
+					t.Errorf("expected bytes beyond quota to exceed it\n")
+				}
+				if !tracker.Allow(downstream2, 100, time.Hour) {
+					t.Errorf("expected another downstream to be allowed\n")
+				}
+				if usage := tracker.Usage(downstream1); usage != 101 {
+					t.Errorf("expected usage of 101, got %v\n", usage)
+				}
+			},
+		},
+		{
+			name: "previous window counts against the quota while it overlaps",
+			op: func(tracker *DownstreamByteQuotas, clock *FakeClock) {
+				tracker.RecordBytes(downstream1, 100, 100, time.Hour)
+
+				// a window and a quarter pass since the window began,
+				// so three quarters of the previous window still overlap
+				clock.Advance(time.Hour + 15*time.Minute)
+				if usage := tracker.Usage(downstream1); usage != 75 {
+					t.Errorf("expected usage of 75, got %v\n", usage)
+				}
+				if !tracker.Allow(downstream1, 100, time.Hour) {
+					t.Errorf("expected new connection to be allowed\n")
+				}
+				if tracker.RecordBytes(downstream1, 50, 100, time.Hour) {
+					t.Errorf("expected bytes to exceed quota with the previous window\n")
+				}
+			},
+		},
+		{
+			name: "deny without a positive window",
+			op: func(tracker *DownstreamByteQuotas, clock *FakeClock) {
+				if tracker.Allow(downstream1, 100, 0) {
+					t.Errorf("expected connection with an empty window to be denied\n")
+				}
+				if tracker.RecordBytes(downstream1, 1, 100, -time.Hour) {
+					t.Errorf("expected bytes with a negative window to be denied\n")
+				}
+				if usage := tracker.Usage(downstream1); usage != 0 {
+					t.Errorf("expected usage of 0, got %v\n", usage)
+				}
+			},
+		},
+		{
+			name: "remove idle downstreams once their windows have passed",
+			op: func(tracker *DownstreamByteQuotas, clock *FakeClock) {
+				tracker.RecordBytes(downstream1, 10, 100, time.Minute)
+				tracker.RecordBytes(downstream2, 10, 100, time.Hour)
+
+				clock.Advance(5 * time.Minute)
+				tracker.RemoveIdle(time.Minute)
+				if _, ok := tracker.windows[downstream1]; ok {
+					t.Errorf("expected empty window of downstream1 to be removed\n")
+				}
+				if _, ok := tracker.windows[downstream2]; !ok {
+					t.Errorf("expected window of downstream2 to be kept\n")
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		clock := NewFakeClock(time.Now())
+		tracker := NewDownstreamByteQuotas()
+		tracker.SetClock(clock)
+		test.op(tracker, clock)
+	}
+}
@@ -0,0 +1,54 @@
+package tracker
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock provides the current time to the trackers,
+// so that time based behavior can be tested without real sleeps.
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+}
+
+// systemClock is a Clock which uses the system time
+type systemClock struct{}
+
+var _ Clock = systemClock{}
+
+// Now returns time.Now()
+func (systemClock) Now() time.Time { return time.Now() }
+
+// FakeClock is a Clock which only moves when told to.
+// FakeClock is safe for concurrent use.
+type FakeClock struct {
+	// mu protects now
+	mu sync.Mutex
+
+	// now is the time returned by Now
+	now time.Time
+}
+
+var _ Clock = (*FakeClock)(nil)
+
+// NewFakeClock returns a FakeClock which starts at now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{
+		now: now,
+	}
+}
+
+// Now returns the current time of the FakeClock
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the FakeClock forward by d
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
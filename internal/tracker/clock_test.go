@@ -0,0 +1,21 @@
+package tracker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	if !clock.Now().Equal(start) {
+		t.Errorf("expected %v, got %v\n", start, clock.Now())
+	}
+
+	clock.Advance(time.Minute)
+	clock.Advance(time.Second)
+	expected := start.Add(time.Minute + time.Second)
+	if !clock.Now().Equal(expected) {
+		t.Errorf("expected %v, got %v\n", expected, clock.Now())
+	}
+}
@@ -0,0 +1,106 @@
+package tracker
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+var errorUnknownKey = errors.New("Unknown Key")
+
+var errorNoConnections = errors.New("No Connections To End")
+
+// counts is a count of connections per key.
+// counts is the counting core shared by the trackers,
+// which provide their own locking and selection on top of it.
+// counts is not safe for concurrent use.
+type counts[K comparable] map[K]uint32
+
+// belowMax checks if a new connection for key fits beneath max.
+// A key with no history always fits beneath its max.
+func (c counts[K]) belowMax(key K, max uint32) bool {
+	value, ok := c[key]
+	return !ok || value < max
+}
+
+// increment records an additional connection for key.
+// If the key has no history, a new count will be started.
+func (c counts[K]) increment(key K) {
+	c[key]++
+}
+
+// decrement records an ended connection for key and returns the remaining count.
+// errorUnknownKey is returned if the key has no history,
+// and errorNoConnections if its count is already 0, leaving the count unchanged.
+func (c counts[K]) decrement(key K) (uint32, error) {
+	if err := c.canDecrement(key); err != nil {
+		return 0, err
+	}
+	c[key]--
+	return c[key], nil
+}
+
+// canDecrement returns the error decrement would for key, without changing the count,
+// so that several counts can be checked before any of them are decremented.
+func (c counts[K]) canDecrement(key K) error {
+	value, ok := c[key]
+	if !ok {
+		return errorUnknownKey
+	}
+	if value == 0 {
+		// guard against underflow from a mismatched decrement
+		return errorNoConnections
+	}
+	return nil
+}
+
+// connTotal is a count of connections across all keys, with an optional ceiling.
+// connTotal is safe for concurrent use, so that trackers
+// which lock per key can share a single total.
+type connTotal struct {
+	// count is the count of connections
+	count atomic.Uint32
+
+	// max is the ceiling for count.
+	// A max of 0 indicates there is no ceiling.
+	max uint32
+}
+
+// reserve records an additional connection if it fits beneath max,
+// leaving at least headroom connections beneath max unused.
+// headroom has no effect if there is no ceiling.
+// The return indicates if the connection was recorded.
+func (t *connTotal) reserve(headroom uint32) bool {
+	if t.max == 0 {
+		t.count.Add(1)
+		return true
+	}
+	for {
+		count := t.count.Load()
+		if count >= t.max || t.max-count <= headroom {
+			return false
+		}
+		if t.count.CompareAndSwap(count, count+1) {
+			return true
+		}
+	}
+}
+
+// release records an ended connection.
+// errorNoConnections is returned if the count is already 0, leaving the count unchanged.
+func (t *connTotal) release() error {
+	for {
+		count := t.count.Load()
+		if count == 0 {
+			// guard against underflow from a mismatched release
+			return errorNoConnections
+		}
+		if t.count.CompareAndSwap(count, count-1) {
+			return nil
+		}
+	}
+}
+
+// load returns the count of connections
+func (t *connTotal) load() uint32 {
+	return t.count.Load()
+}
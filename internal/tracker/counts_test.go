@@ -0,0 +1,103 @@
+package tracker
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestCounts(t *testing.T) {
+	key1 := "key1"
+	key2 := "key2"
+
+	c := counts[string]{}
+	if !c.belowMax(key1, 0) {
+		t.Errorf("expected key with no history to be below max\n")
+	}
+	c.increment(key1)
+	c.increment(key1)
+	c.increment(key2)
+	if c.belowMax(key1, 2) {
+		t.Errorf("expected key at max not to be below max\n")
+	}
+	if !c.belowMax(key2, 2) {
+		t.Errorf("expected key under max to be below max\n")
+	}
+
+	remaining, err := c.decrement(key2)
+	failIfNotNil(t, err)
+	if remaining != 0 {
+		t.Errorf("expected 0 remaining, got %v\n", remaining)
+	}
+	if _, err = c.decrement(key2); !errors.Is(err, errorNoConnections) {
+		t.Errorf("expected error %v, but got %v\n", errorNoConnections, err)
+	}
+	if _, err = c.decrement("key3"); !errors.Is(err, errorUnknownKey) {
+		t.Errorf("expected error %v, but got %v\n", errorUnknownKey, err)
+	}
+	failIfNotNil(t, c.canDecrement(key1))
+	if err = c.canDecrement(key2); !errors.Is(err, errorNoConnections) {
+		t.Errorf("expected error %v, but got %v\n", errorNoConnections, err)
+	}
+
+	expectedCounts := counts[string]{
+		key1: 2,
+		key2: 0,
+	}
+	if !reflect.DeepEqual(expectedCounts, c) {
+		t.Errorf("expectedCounts did not match actualCounts: \n %v != %v\n", expectedCounts, c)
+	}
+}
+
+func TestCountsKeyTypes(t *testing.T) {
+	uuidCounts := counts[uuid.UUID]{}
+	id := uuid.New()
+	uuidCounts.increment(id)
+	if uuidCounts.belowMax(id, 1) {
+		t.Errorf("expected uuid key at max not to be below max\n")
+	}
+
+	groupCounts := counts[downstreamGroup]{}
+	key := downstreamGroup{downstreamID: "downstream1", group: "cache"}
+	groupCounts.increment(key)
+	if remaining, err := groupCounts.decrement(key); err != nil || remaining != 0 {
+		t.Errorf("expected 0 remaining and no error, got %v and %v\n", remaining, err)
+	}
+}
+
+func TestConnTotal(t *testing.T) {
+	total := connTotal{max: 2}
+	if !total.reserve(0) {
+		t.Errorf("expected connection beneath max to be reserved\n")
+	}
+	if total.reserve(1) {
+		t.Errorf("expected connection within headroom not to be reserved\n")
+	}
+	if !total.reserve(0) {
+		t.Errorf("expected connection beneath max to be reserved\n")
+	}
+	if total.reserve(0) {
+		t.Errorf("expected connection at max not to be reserved\n")
+	}
+	if count := total.load(); count != 2 {
+		t.Errorf("expected count of 2, got %v\n", count)
+	}
+
+	failIfNotNil(t, total.release())
+	failIfNotNil(t, total.release())
+	if err := total.release(); !errors.Is(err, errorNoConnections) {
+		t.Errorf("expected error %v, but got %v\n", errorNoConnections, err)
+	}
+	if count := total.load(); count != 0 {
+		t.Errorf("expected count of 0, got %v\n", count)
+	}
+
+	unlimited := connTotal{}
+	for i := 0; i < 3; i++ {
+		if !unlimited.reserve(1) {
+			t.Errorf("expected connection %v to be reserved without a max\n", i)
+		}
+	}
+}
@@ -1,54 +1,593 @@
 package tracker
 
 import (
+	"context"
+	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+var errorUnknownDownstream = errors.New("Unknown Downstream")
+
+// downstreamShardCount is the number of shards downstreams are split between
+const downstreamShardCount = 32
+
 // DownstreamConns tracks connections per downstream based on a
 // unique string identifier.
 // DownstreamConns safe for concurrent use.
 type DownstreamConns struct {
-	// mu protects the resources of DownstreamConns
+	// shards split downstreams by a hash of their downstreamID,
+	// so that connections from unrelated downstreams don't contend on a single mutex.
+	shards [downstreamShardCount]downstreamShard
+
+	// total is the count of connections across all downstreams.
+	// Its max is the globalMax, regardless of per downstream maximums.
+	total connTotal
+
+	// waitMu protects waiters. While there are callers waiting,
+	// waitMu is also held to record and end connections, so that a connection
+	// which ends is handed to the oldest waiter it admits before any other caller.
+	waitMu sync.Mutex
+
+	// waiters are the callers blocked in WaitRecordConnection, oldest first
+	waiters []*downstreamWaiter
+
+	// waiting is the count of callers in WaitRecordConnection
+	// which have not yet been admitted or refused
+	waiting atomic.Uint32
+
+	// hooks are called as connections are recorded, rejected, and ended
+	hooks atomic.Pointer[DownstreamHooks]
+
+	// clock provides the time used to expire idle downstreams
+	clock Clock
+
+	// softLimit is the fraction of a downstream's max at which OnSoftLimit is called.
+	// A softLimit of 0 indicates there is no soft limit.
+	softLimit float64
+}
+
+// DownstreamHooks are optional callbacks which allow DownstreamConns to be observed,
+// for example by metrics, without the tracker depending on them.
+// Hooks are called synchronously from the goroutine recording or ending the connection,
+// so they should be quick. Any hook may be nil.
+type DownstreamHooks struct {
+	// OnRecord is called when a connection for a downstream is recorded
+	OnRecord func(downstreamID string)
+
+	// OnEnd is called when a connection for a downstream is ended
+	OnEnd func(downstreamID string)
+
+	// OnReject is called when a connection for a downstream is refused
+	// because it would exceed a maximum
+	OnReject func(downstreamID string)
+
+	// OnSoftLimit is called when a recorded connection brings the count of
+	// connections for a downstream up to the soft limit set by SetSoftLimit,
+	// so that a downstream can be warned before it is refused.
+	// count is the downstream's new count of connections, and max its maximum.
+	OnSoftLimit func(downstreamID string, count, max uint32)
+}
+
+// A downstreamShard holds the counts for a subset of downstreams.
+type downstreamShard struct {
+	// mu protects the resources of downstreamShard
 	mu sync.Mutex
 
 	// connCounts is a map of downstreamID to a count of connections
-	connCounts map[string]uint32
+	connCounts counts[string]
+
+	// groupCounts is a map of downstreamID and upstream group
+	// to a count of connections to that group
+	groupCounts counts[downstreamGroup]
+
+	// idleSince is a map of downstreamID to the time its count of connections
+	// last reached zero. Only downstreams with no connections are present.
+	idleSince map[string]time.Time
+
+	// bytes is a map of downstreamID to the bytes proxied for it
+	bytes map[string]byteCounts
+}
+
+// byteCounts stores the bytes proxied for a downstream
+type byteCounts struct {
+	// sent is the count of bytes proxied from the downstream
+	sent uint64
+
+	// received is the count of bytes proxied to the downstream
+	received uint64
 }
 
 // NewDownstreamConns initializes and returns a DownstreamConns with
-func NewDownstreamConns() *DownstreamConns {
-	return &DownstreamConns{
-		connCounts: map[string]uint32{},
+// a ceiling on connections across all downstreams.
+// A globalMax of 0 disables the ceiling.
+func NewDownstreamConns(globalMax uint32) *DownstreamConns {
+	t := &DownstreamConns{
+		clock: systemClock{},
+	}
+	t.total.max = globalMax
+	for i := range t.shards {
+		t.shards[i].connCounts = counts[string]{}
+		t.shards[i].groupCounts = counts[downstreamGroup]{}
+		t.shards[i].idleSince = map[string]time.Time{}
+		t.shards[i].bytes = map[string]byteCounts{}
 	}
+	return t
+}
+
+// A downstreamWaiter is a caller blocked in WaitRecordConnection
+type downstreamWaiter struct {
+	// downstreamID and max are the arguments of the caller
+	downstreamID string
+	max          uint32
+
+	// admitted is closed once a connection has been recorded for the caller
+	admitted chan struct{}
+
+	// count is the count of connections for the downstream once admitted
+	count uint32
+}
+
+// downstreamGroup is the key for connections
+// from a downstream to an upstream group.
+type downstreamGroup struct {
+	downstreamID string
+	group        string
 }
 
 // TryRecordConnection checks if a downstreamID's connections are below the provided max
+// and the total connections are below the globalMax,
 // and if so records an additional connection for the downstream.
 // If the downstream has no history, a new count will be started.
 // The return indicates if the new connection should be allowed.
 func (t *DownstreamConns) TryRecordConnection(downstreamID string, max uint32) bool {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	value, ok := t.connCounts[downstreamID]
-	if !ok {
-		t.connCounts[downstreamID] = 1
-		return true
+	count, allowed := t.admit(func() (uint32, bool) {
+		return t.recordConnection(downstreamID, max, 0)
+	})
+	t.observeRecord(downstreamID, max, count, allowed)
+	return allowed
+}
+
+// TryRecordConnectionWithHeadroom is TryRecordConnection for low priority downstreams.
+// The connection is only allowed if it leaves at least headroom connections
+// beneath the globalMax, so that the last connections are kept for
+// higher priority downstreams, which use TryRecordConnection.
+// headroom has no effect if there is no globalMax.
+func (t *DownstreamConns) TryRecordConnectionWithHeadroom(downstreamID string, max, headroom uint32) bool {
+	count, allowed := t.admit(func() (uint32, bool) {
+		return t.recordConnection(downstreamID, max, headroom)
+	})
+	t.observeRecord(downstreamID, max, count, allowed)
+	return allowed
+}
+
+// recordConnection is TryRecordConnectionWithHeadroom without calling hooks.
+// The count of connections for the downstream is returned with if it was allowed.
+func (t *DownstreamConns) recordConnection(downstreamID string, max, headroom uint32) (uint32, bool) {
+	shard := t.shard(downstreamID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if !shard.connCounts.belowMax(downstreamID, max) || !t.reserveTotal(headroom) {
+		return shard.connCounts[downstreamID], false
 	}
-	if value < max {
-		t.connCounts[downstreamID]++
-		return true
+	shard.connCounts.increment(downstreamID)
+	delete(shard.idleSince, downstreamID)
+	return shard.connCounts[downstreamID], true
+}
+
+// WaitRecordConnection is TryRecordConnection, but instead of immediately
+// refusing a connection which is over a maximum it waits for a connection
+// to end, until ctx is done.
+// Waiting callers are admitted in the order they began waiting: a connection
+// which ends is handed to the oldest waiter it makes room for, before newer
+// waiters or callers of TryRecordConnection.
+// At most maxWaiting callers may wait at once, beyond that connections are refused immediately.
+// The return indicates if the new connection should be allowed.
+func (t *DownstreamConns) WaitRecordConnection(ctx context.Context, downstreamID string, max, maxWaiting uint32) bool {
+	count, allowed := t.waitRecordConnection(ctx, downstreamID, max, maxWaiting)
+	t.observeRecord(downstreamID, max, count, allowed)
+	return allowed
+}
+
+// waitRecordConnection is WaitRecordConnection without calling hooks.
+// The count of connections for the downstream is returned with if it was allowed.
+func (t *DownstreamConns) waitRecordConnection(ctx context.Context, downstreamID string, max, maxWaiting uint32) (uint32, bool) {
+	record := func() (uint32, bool) { return t.recordConnection(downstreamID, max, 0) }
+	if count, allowed := t.admit(record); allowed {
+		return count, true
 	}
-	return false
+
+	t.waitMu.Lock()
+	// waiting is counted before trying again, so that a connection
+	// ending during the attempt is either seen by it or handed to the waiter.
+	t.waiting.Add(1)
+	if count, allowed := record(); allowed {
+		t.waiting.Add(^uint32(0))
+		t.waitMu.Unlock()
+		return count, true
+	}
+	if uint32(len(t.waiters)) >= maxWaiting {
+		t.waiting.Add(^uint32(0))
+		t.waitMu.Unlock()
+		return 0, false
+	}
+	w := &downstreamWaiter{
+		downstreamID: downstreamID,
+		max:          max,
+		admitted:     make(chan struct{}),
+	}
+	t.waiters = append(t.waiters, w)
+	t.waitMu.Unlock()
+
+	select {
+	case <-w.admitted:
+		return w.count, true
+	case <-ctx.Done():
+	}
+
+	t.waitMu.Lock()
+	defer t.waitMu.Unlock()
+	select {
+	case <-w.admitted:
+		// admitted before the waiter could be removed
+		return w.count, true
+	default:
+	}
+	for i, waiter := range t.waiters {
+		if waiter == w {
+			t.waiters = append(t.waiters[:i], t.waiters[i+1:]...)
+			break
+		}
+	}
+	t.waiting.Add(^uint32(0))
+	return 0, false
+}
+
+// TryRecordGroupConnection is TryRecordConnection for a connection to an upstream group.
+// In addition to the downstream's max, the downstream's connections to the group
+// must be below the provided groupMax. A groupMax of 0 indicates there is no
+// limit specific to the group.
+// Connections recorded with TryRecordGroupConnection must be ended with GroupConnectionEnded.
+func (t *DownstreamConns) TryRecordGroupConnection(downstreamID, group string, max, groupMax uint32) bool {
+	count, allowed := t.admit(func() (uint32, bool) {
+		return t.recordGroupConnection(downstreamID, group, max, groupMax)
+	})
+	t.observeRecord(downstreamID, max, count, allowed)
+	return allowed
+}
+
+// recordGroupConnection is TryRecordGroupConnection without calling hooks.
+// The count of connections for the downstream is returned with if it was allowed.
+func (t *DownstreamConns) recordGroupConnection(downstreamID, group string, max, groupMax uint32) (uint32, bool) {
+	shard := t.shard(downstreamID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if !shard.connCounts.belowMax(downstreamID, max) {
+		return shard.connCounts[downstreamID], false
+	}
+	key := downstreamGroup{downstreamID: downstreamID, group: group}
+	if groupMax != 0 && !shard.groupCounts.belowMax(key, groupMax) {
+		return shard.connCounts[downstreamID], false
+	}
+	if !t.reserveTotal(0) {
+		return shard.connCounts[downstreamID], false
+	}
+	shard.groupCounts.increment(key)
+	shard.connCounts.increment(downstreamID)
+	delete(shard.idleSince, downstreamID)
+	return shard.connCounts[downstreamID], true
 }
 
 // ConnectionEnded decrements the count of connections for a given downstreamID.
-func (t *DownstreamConns) ConnectionEnded(downstreamID string) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	_, ok := t.connCounts[downstreamID]
-	if !ok {
-		// id was not found
+// An error is returned if the downstream is unknown or has no connections to end.
+func (t *DownstreamConns) ConnectionEnded(downstreamID string) error {
+	err := t.endConnection(func() error {
+		shard := t.shard(downstreamID)
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+		return shard.connEnded(downstreamID, t.clock.Now())
+	})
+	if err != nil {
+		return err
+	}
+
+	if hooks := t.hooks.Load(); hooks != nil && hooks.OnEnd != nil {
+		hooks.OnEnd(downstreamID)
+	}
+	return nil
+}
+
+// GroupConnectionEnded decrements the count of connections for a given downstreamID
+// and its count of connections to the given group.
+// An error is returned if the downstream has never connected to the group
+// or has no connections to the group to end.
+func (t *DownstreamConns) GroupConnectionEnded(downstreamID, group string) error {
+	err := t.endConnection(func() error {
+		shard := t.shard(downstreamID)
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+		key := downstreamGroup{downstreamID: downstreamID, group: group}
+		// connections to a group are also counted by connCounts,
+		// both are checked so that neither is changed if the other can't be.
+		if err := shard.groupCounts.canDecrement(key); err != nil {
+			return err
+		}
+		if err := shard.connCounts.canDecrement(downstreamID); err != nil {
+			return err
+		}
+		shard.groupCounts.decrement(key)
+		return shard.connEnded(downstreamID, t.clock.Now())
+	})
+	if errors.Is(err, errorUnknownKey) {
+		return errorUnknownDownstream
+	}
+	if err != nil {
+		return err
+	}
+
+	if hooks := t.hooks.Load(); hooks != nil && hooks.OnEnd != nil {
+		hooks.OnEnd(downstreamID)
+	}
+	return nil
+}
+
+// SetClock replaces the Clock used by DownstreamConns,
+// and must be called before DownstreamConns is used.
+func (t *DownstreamConns) SetClock(clock Clock) {
+	t.clock = clock
+}
+
+// SetSoftLimit sets the fraction of a downstream's max at which OnSoftLimit is called,
+// for example 0.8 to warn once a downstream reaches 80% of its max.
+// A fraction of 0 disables the soft limit, which is the default.
+// SetSoftLimit must be called before DownstreamConns is used.
+func (t *DownstreamConns) SetSoftLimit(fraction float64) {
+	t.softLimit = fraction
+}
+
+// SetHooks replaces the hooks called by DownstreamConns.
+func (t *DownstreamConns) SetHooks(hooks DownstreamHooks) {
+	t.hooks.Store(&hooks)
+}
+
+// observeRecord calls OnRecord or OnReject, based on if a connection was allowed,
+// and OnSoftLimit if the allowed connection brought count up to the soft limit of max.
+func (t *DownstreamConns) observeRecord(downstreamID string, max, count uint32, allowed bool) {
+	hooks := t.hooks.Load()
+	if hooks == nil {
 		return
 	}
-	t.connCounts[downstreamID]--
+	if allowed && hooks.OnRecord != nil {
+		hooks.OnRecord(downstreamID)
+	}
+	if !allowed && hooks.OnReject != nil {
+		hooks.OnReject(downstreamID)
+	}
+	if allowed && hooks.OnSoftLimit != nil && t.reachedSoftLimit(count, max) {
+		hooks.OnSoftLimit(downstreamID, count, max)
+	}
+}
+
+// reachedSoftLimit checks if count is the first count at or above the soft limit of max.
+// Counts change by one connection at a time, so a downstream crossing
+// the soft limit always reaches exactly this count.
+func (t *DownstreamConns) reachedSoftLimit(count, max uint32) bool {
+	if t.softLimit <= 0 || max == 0 {
+		return false
+	}
+	return float64(count) >= t.softLimit*float64(max) && float64(count-1) < t.softLimit*float64(max)
+}
+
+// Downstreams returns the downstreamIDs which are currently tracked,
+// including those with no connections which have not yet been removed by RemoveIdle.
+func (t *DownstreamConns) Downstreams() []string {
+	downstreamIDs := []string{}
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.mu.Lock()
+		for downstreamID := range shard.connCounts {
+			downstreamIDs = append(downstreamIDs, downstreamID)
+		}
+		shard.mu.Unlock()
+	}
+	return downstreamIDs
+}
+
+// RecordBytes adds to the counts of bytes proxied from and to a downstream.
+// An error is returned if the downstream is unknown,
+// including once it has been removed by RemoveIdle.
+func (t *DownstreamConns) RecordBytes(downstreamID string, sent, received uint64) error {
+	shard := t.shard(downstreamID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if _, ok := shard.connCounts[downstreamID]; !ok {
+		return errorUnknownDownstream
+	}
+	counts := shard.bytes[downstreamID]
+	counts.sent += sent
+	counts.received += received
+	shard.bytes[downstreamID] = counts
+	return nil
+}
+
+// DownstreamSnapshot is a copy of the connections of a downstream at a point in time
+type DownstreamSnapshot struct {
+	// ConnCount is the count of connections from the downstream
+	ConnCount uint32
+
+	// GroupConnCounts is a map of upstream group to the count of connections
+	// from the downstream recorded with TryRecordGroupConnection
+	GroupConnCounts map[string]uint32
+
+	// BytesSent is the count of bytes proxied from the downstream
+	// since it began being tracked. The count is reset when RemoveIdle
+	// removes the downstream, which returns the final count.
+	BytesSent uint64
+
+	// BytesReceived is the count of bytes proxied to the downstream,
+	// counted and reset like BytesSent.
+	BytesReceived uint64
+}
+
+// Snapshot returns a copy of the connections of every tracked downstream, by downstreamID.
+// Each shard is copied separately, so the snapshot is consistent per downstream
+// but may not reflect a single instant across all downstreams.
+func (t *DownstreamConns) Snapshot() map[string]DownstreamSnapshot {
+	snapshot := map[string]DownstreamSnapshot{}
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.mu.Lock()
+		for downstreamID, count := range shard.connCounts {
+			bytes := shard.bytes[downstreamID]
+			snapshot[downstreamID] = DownstreamSnapshot{
+				ConnCount:       count,
+				GroupConnCounts: map[string]uint32{},
+				BytesSent:       bytes.sent,
+				BytesReceived:   bytes.received,
+			}
+		}
+		for key, count := range shard.groupCounts {
+			snapshot[key.downstreamID].GroupConnCounts[key.group] = count
+		}
+		shard.mu.Unlock()
+	}
+	return snapshot
+}
+
+// TotalConns returns the count of connections across all downstreams
+func (t *DownstreamConns) TotalConns() uint32 {
+	return t.total.load()
+}
+
+// RemoveIdle stops tracking downstreams which have had no connections for at least ttl.
+// RemoveIdle is intended to be called periodically, so that downstreams
+// which are no longer connecting don't accumulate forever.
+// A final snapshot of each removed downstream is returned, by downstreamID,
+// so that its byte counts can be accounted for before they are dropped.
+func (t *DownstreamConns) RemoveIdle(ttl time.Duration) map[string]DownstreamSnapshot {
+	removed := map[string]DownstreamSnapshot{}
+	now := t.clock.Now()
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.mu.Lock()
+		for downstreamID, idleSince := range shard.idleSince {
+			if now.Sub(idleSince) < ttl {
+				continue
+			}
+			bytes := shard.bytes[downstreamID]
+			removed[downstreamID] = DownstreamSnapshot{
+				GroupConnCounts: map[string]uint32{},
+				BytesSent:       bytes.sent,
+				BytesReceived:   bytes.received,
+			}
+			delete(shard.idleSince, downstreamID)
+			delete(shard.connCounts, downstreamID)
+			delete(shard.bytes, downstreamID)
+		}
+		for key := range shard.groupCounts {
+			if _, ok := shard.connCounts[key.downstreamID]; !ok {
+				// connections to a group are also counted by connCounts,
+				// so a removed downstream has no connections to any group.
+				delete(shard.groupCounts, key)
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return removed
+}
+
+// shard returns the downstreamShard responsible for downstreamID
+func (t *DownstreamConns) shard(downstreamID string) *downstreamShard {
+	// 32 bit FNV-1a, inlined to avoid allocating a hash.Hash32
+	hash := uint32(2166136261)
+	for i := 0; i < len(downstreamID); i++ {
+		hash ^= uint32(downstreamID[i])
+		hash *= 16777619
+	}
+	return &t.shards[hash%downstreamShardCount]
+}
+
+// reserveTotal records an additional connection in total
+// if it is below the globalMax, leaving at least headroom connections unused.
+// The return indicates if the connection was recorded.
+func (t *DownstreamConns) reserveTotal(headroom uint32) bool {
+	return t.total.reserve(headroom)
+}
+
+// admit calls record to record a new connection.
+// While there are callers waiting, waitMu is held,
+// so that record can't take a connection which is being handed to a waiter.
+func (t *DownstreamConns) admit(record func() (uint32, bool)) (uint32, bool) {
+	if t.waiting.Load() > 0 {
+		t.waitMu.Lock()
+		defer t.waitMu.Unlock()
+	}
+	return record()
+}
+
+// endConnection calls end to record an ended connection, releases it from total,
+// and then admits any callers of WaitRecordConnection it makes room for, oldest first.
+func (t *DownstreamConns) endConnection(end func() error) error {
+	if t.waiting.Load() == 0 {
+		if err := end(); err != nil {
+			return err
+		}
+		t.total.release()
+		if t.waiting.Load() == 0 {
+			return nil
+		}
+		// a caller began waiting while the connection ended
+		t.waitMu.Lock()
+		t.admitWaiters()
+		t.waitMu.Unlock()
+		return nil
+	}
+
+	t.waitMu.Lock()
+	defer t.waitMu.Unlock()
+	if err := end(); err != nil {
+		return err
+	}
+	t.total.release()
+	t.admitWaiters()
+	return nil
+}
+
+// admitWaiters records a connection for each waiter which fits beneath its maximums,
+// oldest first, and wakes them.
+// admitWaiters assumes t.waitMu is held.
+func (t *DownstreamConns) admitWaiters() {
+	remaining := t.waiters[:0]
+	for _, w := range t.waiters {
+		count, allowed := t.recordConnection(w.downstreamID, w.max, 0)
+		if !allowed {
+			remaining = append(remaining, w)
+			continue
+		}
+		w.count = count
+		close(w.admitted)
+		t.waiting.Add(^uint32(0))
+	}
+	for i := len(remaining); i < len(t.waiters); i++ {
+		t.waiters[i] = nil // avoid memory leak
+	}
+	t.waiters = remaining
+}
+
+// connEnded decrements the count of connections for a downstreamID
+// and records now as when the downstream became idle.
+// connEnded assumes s.mu is held.
+func (s *downstreamShard) connEnded(downstreamID string, now time.Time) error {
+	remaining, err := s.connCounts.decrement(downstreamID)
+	if errors.Is(err, errorUnknownKey) {
+		return errorUnknownDownstream
+	}
+	if err != nil {
+		return err
+	}
+	if remaining == 0 {
+		s.idleSince[downstreamID] = now
+	}
+	return nil
 }
@@ -1,9 +1,14 @@
 package tracker
 
 import (
+	"context"
+	"errors"
 	"reflect"
+	"sort"
+	"strconv"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestDownstreamConnsCounts(t *testing.T) {
@@ -99,11 +104,487 @@ func TestDownstreamConnsCounts(t *testing.T) {
 	}
 
 	for i, test := range tests {
-		tracker := NewDownstreamConns()
+		tracker := NewDownstreamConns(0)
 		test.op(tracker)
-		actualCounts := tracker.connCounts
+		actualCounts := tracker.connCounts()
 		if !reflect.DeepEqual(test.expectedCounts, actualCounts) {
 			t.Errorf("test(%v) expectedCounts did not match actualCounts: \n %v != %v\n", i, test.expectedCounts, actualCounts)
 		}
 	}
 }
+
+func TestDownstreamConnsGlobalMax(t *testing.T) {
+	downstream1 := "downstream1"
+	downstream2 := "downstream2"
+
+	tracker := NewDownstreamConns(3)
+	if !tracker.TryRecordConnection(downstream1, 10) {
+		t.Errorf("expected connection to be allowed\n")
+	}
+	if !tracker.TryRecordConnection(downstream1, 10) {
+		t.Errorf("expected connection to be allowed\n")
+	}
+	if !tracker.TryRecordConnection(downstream2, 10) {
+		t.Errorf("expected connection to be allowed\n")
+	}
+
+	// this connection should not be recorded because of the global maximum
+	if tracker.TryRecordConnection(downstream2, 10) {
+		t.Errorf("expected connection beyond global maximum to be denied\n")
+	}
+
+	tracker.ConnectionEnded(downstream1)
+	if !tracker.TryRecordConnection(downstream2, 10) {
+		t.Errorf("expected connection to be allowed after another ended\n")
+	}
+
+	expectedCounts := map[string]uint32{
+		downstream1: 1,
+		downstream2: 2,
+	}
+	if !reflect.DeepEqual(expectedCounts, tracker.connCounts()) {
+		t.Errorf("expectedCounts did not match actualCounts: \n %v != %v\n", expectedCounts, tracker.connCounts())
+	}
+	if total := tracker.total.load(); total != 3 {
+		t.Errorf("expected total of 3, got %v\n", total)
+	}
+}
+
+func TestDownstreamConnsHeadroom(t *testing.T) {
+	batch := "batch"
+	customer := "customer"
+
+	tracker := NewDownstreamConns(3)
+	if !tracker.TryRecordConnectionWithHeadroom(batch, 10, 1) {
+		t.Errorf("expected connection to be allowed\n")
+	}
+	if !tracker.TryRecordConnectionWithHeadroom(batch, 10, 1) {
+		t.Errorf("expected connection to be allowed\n")
+	}
+
+	// the last connection beneath the global maximum is kept for higher priority downstreams
+	if tracker.TryRecordConnectionWithHeadroom(batch, 10, 1) {
+		t.Errorf("expected connection within headroom to be denied\n")
+	}
+	if !tracker.TryRecordConnection(customer, 10) {
+		t.Errorf("expected connection without headroom to be allowed\n")
+	}
+
+	// headroom has no effect without a global maximum
+	tracker = NewDownstreamConns(0)
+	if !tracker.TryRecordConnectionWithHeadroom(batch, 10, 5) {
+		t.Errorf("expected connection without a global maximum to be allowed\n")
+	}
+}
+
+func TestDownstreamConnsGroupCounts(t *testing.T) {
+	downstream1 := "downstream1"
+	cacheGroup := "cache"
+	databaseGroup := "database"
+
+	tracker := NewDownstreamConns(0)
+	for i := 0; i < 3; i++ {
+		if !tracker.TryRecordGroupConnection(downstream1, cacheGroup, 5, 0) {
+			t.Errorf("expected connection %v to cache to be allowed\n", i)
+		}
+	}
+	if !tracker.TryRecordGroupConnection(downstream1, databaseGroup, 5, 1) {
+		t.Errorf("expected connection to database to be allowed\n")
+	}
+
+	// this connection should not be recorded because of the group maximum
+	if tracker.TryRecordGroupConnection(downstream1, databaseGroup, 5, 1) {
+		t.Errorf("expected connection beyond group maximum to be denied\n")
+	}
+
+	// the downstream maximum still applies across groups
+	if !tracker.TryRecordGroupConnection(downstream1, cacheGroup, 5, 0) {
+		t.Errorf("expected connection to cache to be allowed\n")
+	}
+	if tracker.TryRecordGroupConnection(downstream1, cacheGroup, 5, 0) {
+		t.Errorf("expected connection beyond downstream maximum to be denied\n")
+	}
+
+	tracker.GroupConnectionEnded(downstream1, databaseGroup)
+	tracker.GroupConnectionEnded(downstream1, cacheGroup)
+
+	expectedCounts := map[string]uint32{
+		downstream1: 3,
+	}
+	if !reflect.DeepEqual(expectedCounts, tracker.connCounts()) {
+		t.Errorf("expectedCounts did not match actualCounts: \n %v != %v\n", expectedCounts, tracker.connCounts())
+	}
+	expectedGroupCounts := map[downstreamGroup]uint32{
+		{downstreamID: downstream1, group: cacheGroup}:    3,
+		{downstreamID: downstream1, group: databaseGroup}: 0,
+	}
+	if !reflect.DeepEqual(expectedGroupCounts, tracker.groupCounts()) {
+		t.Errorf("expectedGroupCounts did not match actualGroupCounts: \n %v != %v\n", expectedGroupCounts, tracker.groupCounts())
+	}
+}
+
+func TestDownstreamConnsWaitRecordConnection(t *testing.T) {
+	downstream1 := "downstream1"
+
+	tracker := NewDownstreamConns(0)
+	if !tracker.WaitRecordConnection(context.Background(), downstream1, 1, 1) {
+		t.Errorf("expected connection under maximum to be allowed immediately\n")
+	}
+
+	// a waiting connection is refused once ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if tracker.WaitRecordConnection(ctx, downstream1, 1, 1) {
+		t.Errorf("expected waiting connection to be refused after timeout\n")
+	}
+
+	// a waiting connection is admitted once another ends
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	var allowed bool
+	go func() {
+		allowed = tracker.WaitRecordConnection(context.Background(), downstream1, 1, 1)
+		wg.Done()
+	}()
+
+	// wait for the goroutine to begin waiting
+	for {
+		if tracker.waiting.Load() == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the wait queue is full, so this connection is refused immediately
+	if tracker.WaitRecordConnection(context.Background(), downstream1, 1, 1) {
+		t.Errorf("expected connection beyond maxWaiting to be refused\n")
+	}
+
+	tracker.ConnectionEnded(downstream1)
+	wg.Wait()
+	if !allowed {
+		t.Errorf("expected waiting connection to be allowed after another ended\n")
+	}
+
+	expectedCounts := map[string]uint32{
+		downstream1: 1,
+	}
+	if !reflect.DeepEqual(expectedCounts, tracker.connCounts()) {
+		t.Errorf("expectedCounts did not match actualCounts: \n %v != %v\n", expectedCounts, tracker.connCounts())
+	}
+}
+
+func TestDownstreamConnsWaitRecordConnectionOrder(t *testing.T) {
+	downstream1 := "downstream1"
+
+	tracker := NewDownstreamConns(0)
+	tracker.TryRecordConnection(downstream1, 1)
+
+	// waiters begin waiting one at a time, so their order is known
+	admitted := make([]chan bool, 2)
+	for i := range admitted {
+		admitted[i] = make(chan bool, 1)
+		go func(i int) {
+			admitted[i] <- tracker.WaitRecordConnection(context.Background(), downstream1, 1, 2)
+		}(i)
+		for tracker.waiting.Load() != uint32(i+1) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// the ended connection is handed to the oldest waiter, not a new caller
+	tracker.ConnectionEnded(downstream1)
+	if !<-admitted[0] {
+		t.Errorf("expected oldest waiting connection to be allowed\n")
+	}
+	if tracker.TryRecordConnection(downstream1, 1) {
+		t.Errorf("expected new connection not to take the slot of a waiter\n")
+	}
+	select {
+	case <-admitted[1]:
+		t.Errorf("expected newer waiting connection to still be waiting\n")
+	default:
+	}
+
+	tracker.ConnectionEnded(downstream1)
+	if !<-admitted[1] {
+		t.Errorf("expected newer waiting connection to be allowed\n")
+	}
+	if waiting := tracker.waiting.Load(); waiting != 0 {
+		t.Errorf("expected no waiting connections, got %v\n", waiting)
+	}
+}
+
+func TestDownstreamConnsSoftLimit(t *testing.T) {
+	downstream1 := "downstream1"
+	cacheGroup := "cache"
+
+	var softLimits []uint32
+	tracker := NewDownstreamConns(0)
+	tracker.SetSoftLimit(0.8)
+	tracker.SetHooks(DownstreamHooks{
+		OnSoftLimit: func(downstreamID string, count, max uint32) {
+			if max != 5 {
+				t.Errorf("expected max of 5, got %v\n", max)
+			}
+			softLimits = append(softLimits, count)
+		},
+	})
+
+	// 80% of 5 is reached by the 4th connection, and not again by the 5th
+	for i := 0; i < 3; i++ {
+		tracker.TryRecordConnection(downstream1, 5)
+	}
+	tracker.TryRecordGroupConnection(downstream1, cacheGroup, 5, 0)
+	tracker.TryRecordConnection(downstream1, 5)
+	tracker.TryRecordConnection(downstream1, 5)
+	if !reflect.DeepEqual([]uint32{4}, softLimits) {
+		t.Errorf("expected soft limit to be reached once at 4, got %v\n", softLimits)
+	}
+
+	// dropping beneath the soft limit and reaching it again warns again
+	tracker.ConnectionEnded(downstream1)
+	tracker.ConnectionEnded(downstream1)
+	tracker.TryRecordConnection(downstream1, 5)
+	if !reflect.DeepEqual([]uint32{4, 4}, softLimits) {
+		t.Errorf("expected soft limit to be reached again at 4, got %v\n", softLimits)
+	}
+
+	// without a soft limit OnSoftLimit is never called
+	tracker.SetSoftLimit(0)
+	tracker.ConnectionEnded(downstream1)
+	tracker.TryRecordConnection(downstream1, 5)
+	if len(softLimits) != 2 {
+		t.Errorf("expected no further soft limits, got %v\n", softLimits)
+	}
+}
+
+// connCounts merges the connCounts of every shard
+func (t *DownstreamConns) connCounts() map[string]uint32 {
+	counts := map[string]uint32{}
+	for i := range t.shards {
+		for id, count := range t.shards[i].connCounts {
+			counts[id] = count
+		}
+	}
+	return counts
+}
+
+// groupCounts merges the groupCounts of every shard
+func (t *DownstreamConns) groupCounts() map[downstreamGroup]uint32 {
+	counts := map[downstreamGroup]uint32{}
+	for i := range t.shards {
+		for key, count := range t.shards[i].groupCounts {
+			counts[key] = count
+		}
+	}
+	return counts
+}
+
+func BenchmarkDownstreamConns(b *testing.B) {
+	downstreamIDs := make([]string, 1000)
+	for i := range downstreamIDs {
+		downstreamIDs[i] = "downstream" + strconv.Itoa(i)
+	}
+
+	tracker := NewDownstreamConns(0)
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			downstreamID := downstreamIDs[i%len(downstreamIDs)]
+			if tracker.TryRecordConnection(downstreamID, 10) {
+				tracker.ConnectionEnded(downstreamID)
+			}
+			i++
+		}
+	})
+}
+
+func TestDownstreamConnsRemoveIdle(t *testing.T) {
+	downstream1 := "downstream1"
+	downstream2 := "downstream2"
+	cacheGroup := "cache"
+
+	clock := NewFakeClock(time.Now())
+	tracker := NewDownstreamConns(0)
+	tracker.SetClock(clock)
+	tracker.TryRecordConnection(downstream1, 10)
+	tracker.TryRecordGroupConnection(downstream2, cacheGroup, 10, 0)
+	tracker.TryRecordConnection(downstream2, 10)
+	tracker.RecordBytes(downstream2, 10, 20)
+	tracker.GroupConnectionEnded(downstream2, cacheGroup)
+	tracker.ConnectionEnded(downstream2)
+
+	// downstream2 has only just become idle
+	if removed := tracker.RemoveIdle(time.Hour); len(removed) != 0 {
+		t.Errorf("expected no downstreams to be removed, got %v\n", removed)
+	}
+	downstreamIDs := tracker.Downstreams()
+	sort.Strings(downstreamIDs)
+	if !reflect.DeepEqual([]string{downstream1, downstream2}, downstreamIDs) {
+		t.Errorf("expected both downstreams to be tracked, got %v\n", downstreamIDs)
+	}
+
+	// downstream2 has now been idle for longer than the ttl
+	clock.Advance(2 * time.Hour)
+	removed := tracker.RemoveIdle(time.Hour)
+	expectedRemoved := map[string]DownstreamSnapshot{
+		downstream2: {
+			GroupConnCounts: map[string]uint32{},
+			BytesSent:       10,
+			BytesReceived:   20,
+		},
+	}
+	if !reflect.DeepEqual(expectedRemoved, removed) {
+		t.Errorf("expected final snapshot of removed downstream: \n %v != %v\n", expectedRemoved, removed)
+	}
+	downstreamIDs = tracker.Downstreams()
+	if !reflect.DeepEqual([]string{downstream1}, downstreamIDs) {
+		t.Errorf("expected only downstream1 to be tracked, got %v\n", downstreamIDs)
+	}
+	if groupCounts := tracker.groupCounts(); len(groupCounts) != 0 {
+		t.Errorf("expected group counts of removed downstream to be removed, got %v\n", groupCounts)
+	}
+
+	// removed downstreams start a new count
+	if !tracker.TryRecordConnection(downstream2, 1) {
+		t.Errorf("expected connection to be allowed\n")
+	}
+}
+
+func TestDownstreamConnsSnapshot(t *testing.T) {
+	downstream1 := "downstream1"
+	downstream2 := "downstream2"
+	cacheGroup := "cache"
+
+	tracker := NewDownstreamConns(0)
+	tracker.TryRecordConnection(downstream1, 10)
+	tracker.TryRecordConnection(downstream1, 10)
+	tracker.TryRecordGroupConnection(downstream2, cacheGroup, 10, 0)
+
+	expectedSnapshot := map[string]DownstreamSnapshot{
+		downstream1: {
+			ConnCount:       2,
+			GroupConnCounts: map[string]uint32{},
+		},
+		downstream2: {
+			ConnCount: 1,
+			GroupConnCounts: map[string]uint32{
+				cacheGroup: 1,
+			},
+		},
+	}
+	snapshot := tracker.Snapshot()
+	if !reflect.DeepEqual(expectedSnapshot, snapshot) {
+		t.Errorf("expectedSnapshot did not match actualSnapshot: \n %v != %v\n", expectedSnapshot, snapshot)
+	}
+	if total := tracker.TotalConns(); total != 3 {
+		t.Errorf("expected total of 3, got %v\n", total)
+	}
+
+	// the snapshot is a copy, and does not change with the tracker
+	tracker.ConnectionEnded(downstream1)
+	if snapshot[downstream1].ConnCount != 2 {
+		t.Errorf("expected snapshot to be unchanged, got %v\n", snapshot[downstream1].ConnCount)
+	}
+}
+
+func TestDownstreamConnsConnectionEndedErrors(t *testing.T) {
+	downstream1 := "downstream1"
+	cacheGroup := "cache"
+
+	tracker := NewDownstreamConns(0)
+	if err := tracker.ConnectionEnded(downstream1); !errors.Is(err, errorUnknownDownstream) {
+		t.Errorf("expected error %v, but got %v\n", errorUnknownDownstream, err)
+	}
+	if err := tracker.GroupConnectionEnded(downstream1, cacheGroup); !errors.Is(err, errorUnknownDownstream) {
+		t.Errorf("expected error %v, but got %v\n", errorUnknownDownstream, err)
+	}
+
+	tracker.TryRecordGroupConnection(downstream1, cacheGroup, 10, 0)
+	if err := tracker.GroupConnectionEnded(downstream1, cacheGroup); err != nil {
+		t.Errorf("unexpected error: %v\n", err)
+	}
+
+	// ending more connections than were recorded must not underflow
+	if err := tracker.GroupConnectionEnded(downstream1, cacheGroup); !errors.Is(err, errorNoConnections) {
+		t.Errorf("expected error %v, but got %v\n", errorNoConnections, err)
+	}
+	if err := tracker.ConnectionEnded(downstream1); !errors.Is(err, errorNoConnections) {
+		t.Errorf("expected error %v, but got %v\n", errorNoConnections, err)
+	}
+	if total := tracker.TotalConns(); total != 0 {
+		t.Errorf("expected total of 0, got %v\n", total)
+	}
+	if !tracker.TryRecordConnection(downstream1, 1) {
+		t.Errorf("expected connection to be allowed\n")
+	}
+	if tracker.TryRecordConnection(downstream1, 1) {
+		t.Errorf("expected connection beyond maximum to be denied\n")
+	}
+
+	// a group connection mistakenly ended with ConnectionEnded
+	// leaves the group count unchanged when GroupConnectionEnded fails
+	tracker = NewDownstreamConns(0)
+	tracker.TryRecordGroupConnection(downstream1, cacheGroup, 10, 0)
+	failIfNotNil(t, tracker.ConnectionEnded(downstream1))
+	if err := tracker.GroupConnectionEnded(downstream1, cacheGroup); !errors.Is(err, errorNoConnections) {
+		t.Errorf("expected error %v, but got %v\n", errorNoConnections, err)
+	}
+	expectedGroupCounts := map[downstreamGroup]uint32{
+		{downstreamID: downstream1, group: cacheGroup}: 1,
+	}
+	if !reflect.DeepEqual(expectedGroupCounts, tracker.groupCounts()) {
+		t.Errorf("expectedGroupCounts did not match actualGroupCounts: \n %v != %v\n", expectedGroupCounts, tracker.groupCounts())
+	}
+}
+
+func TestDownstreamConnsRecordBytes(t *testing.T) {
+	downstream1 := "downstream1"
+
+	tracker := NewDownstreamConns(0)
+	if err := tracker.RecordBytes(downstream1, 1, 1); !errors.Is(err, errorUnknownDownstream) {
+		t.Errorf("expected error %v, but got %v\n", errorUnknownDownstream, err)
+	}
+
+	tracker.TryRecordConnection(downstream1, 10)
+	failIfNotNil(t, tracker.RecordBytes(downstream1, 10, 100))
+	failIfNotNil(t, tracker.RecordBytes(downstream1, 5, 0))
+
+	snapshot := tracker.Snapshot()[downstream1]
+	if snapshot.BytesSent != 15 || snapshot.BytesReceived != 100 {
+		t.Errorf("expected 15 bytes sent and 100 received, got %v and %v\n", snapshot.BytesSent, snapshot.BytesReceived)
+	}
+}
+
+func TestDownstreamConnsHooks(t *testing.T) {
+	downstream1 := "downstream1"
+	cacheGroup := "cache"
+
+	var records, ends, rejects []string
+	tracker := NewDownstreamConns(0)
+	tracker.SetHooks(DownstreamHooks{
+		OnRecord: func(downstreamID string) { records = append(records, downstreamID) },
+		OnEnd:    func(downstreamID string) { ends = append(ends, downstreamID) },
+		OnReject: func(downstreamID string) { rejects = append(rejects, downstreamID) },
+	})
+
+	tracker.TryRecordConnection(downstream1, 1)
+	tracker.TryRecordConnection(downstream1, 1)
+	tracker.ConnectionEnded(downstream1)
+	tracker.TryRecordGroupConnection(downstream1, cacheGroup, 1, 0)
+	tracker.GroupConnectionEnded(downstream1, cacheGroup)
+
+	// ending a connection which doesn't exist is not observed
+	tracker.ConnectionEnded(downstream1)
+
+	if !reflect.DeepEqual([]string{downstream1, downstream1}, records) {
+		t.Errorf("expected 2 records, got %v\n", records)
+	}
+	if !reflect.DeepEqual([]string{downstream1, downstream1}, ends) {
+		t.Errorf("expected 2 ends, got %v\n", ends)
+	}
+	if !reflect.DeepEqual([]string{downstream1}, rejects) {
+		t.Errorf("expected 1 reject, got %v\n", rejects)
+	}
+}
@@ -0,0 +1,159 @@
+package tracker
+
+import (
+	"sync"
+	"time"
+)
+
+// DownstreamQuotas limits the number of connections per downstream
+// over a rolling window, based on a unique string identifier.
+// The rolling window is approximated by weighting the count of the
+// previous fixed window by how much of it still overlaps the rolling window.
+// DownstreamQuotas is safe for concurrent use.
+type DownstreamQuotas struct {
+	// mu protects the resources of DownstreamQuotas
+	mu sync.Mutex
+
+	// windows is a map of downstreamID to a quotaWindow
+	windows map[string]*quotaWindow
+
+	// clock provides the time used to advance windows
+	clock Clock
+}
+
+// A quotaWindow stores the usage of a downstream, such as connections started
+// or bytes proxied, in the current and previous fixed windows.
+type quotaWindow struct {
+	// length is the duration of a window
+	length time.Duration
+
+	// start is the time at which the current window began
+	start time.Time
+
+	// count is the usage in the current window
+	count uint64
+
+	// prevCount is the usage in the previous window
+	prevCount uint64
+
+	// last is the time at which usage was last recorded
+	last time.Time
+}
+
+// NewDownstreamQuotas initializes and returns a DownstreamQuotas
+func NewDownstreamQuotas() *DownstreamQuotas {
+	return &DownstreamQuotas{
+		windows: map[string]*quotaWindow{},
+		clock:   systemClock{},
+	}
+}
+
+// SetClock replaces the Clock used by DownstreamQuotas,
+// and must be called before DownstreamQuotas is used.
+func (t *DownstreamQuotas) SetClock(clock Clock) {
+	t.clock = clock
+}
+
+// TryRecordConnection checks if a downstreamID's connections over the last window
+// are below the provided max and if so records an additional connection for the downstream.
+// If the downstream has no history, or the window has changed, a new count will be started.
+// A window must be positive, otherwise the connection is not allowed.
+// The return indicates if the new connection should be allowed.
+func (t *DownstreamQuotas) TryRecordConnection(downstreamID string, max uint32, window time.Duration) bool {
+	if window <= 0 {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	w := windowFor(t.windows, downstreamID, window, now)
+	if w.estimate(now) >= float64(max) {
+		return false
+	}
+	w.count++
+	w.last = now
+	return true
+}
+
+// Usage returns the estimated count of connections started by a downstreamID
+// over its last window. A downstream with no history has a Usage of 0.
+func (t *DownstreamQuotas) Usage(downstreamID string) uint32 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	w, ok := t.windows[downstreamID]
+	if !ok {
+		return 0
+	}
+	now := t.clock.Now()
+	w.advance(now)
+	return uint32(w.estimate(now))
+}
+
+// RemoveIdle stops tracking downstreams which have not recorded a connection for at least ttl
+// and whose windows no longer hold any connections. Such a downstream is no different from
+// a downstream with no history, so no quota is lost.
+// RemoveIdle is intended to be called periodically, so that downstreams
+// which are no longer connecting don't accumulate forever.
+func (t *DownstreamQuotas) RemoveIdle(ttl time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	removeIdleWindows(t.windows, t.clock.Now(), ttl)
+}
+
+// windowFor returns the quotaWindow of downstreamID, advanced to now.
+// If the downstream has no history, or the window has changed, a new window will be started.
+func windowFor(windows map[string]*quotaWindow, downstreamID string, length time.Duration, now time.Time) *quotaWindow {
+	w, ok := windows[downstreamID]
+	if !ok || w.length != length {
+		w = &quotaWindow{
+			length: length,
+			start:  now,
+		}
+		windows[downstreamID] = w
+	}
+	w.advance(now)
+	return w
+}
+
+// removeIdleWindows deletes windows which have not recorded usage for at least ttl
+// and which no longer hold any usage.
+func removeIdleWindows(windows map[string]*quotaWindow, now time.Time, ttl time.Duration) {
+	for downstreamID, w := range windows {
+		if now.Sub(w.last) < ttl {
+			continue
+		}
+		w.advance(now)
+		if w.count != 0 || w.prevCount != 0 {
+			continue
+		}
+		delete(windows, downstreamID)
+	}
+}
+
+// advance moves the current window forward so that it contains now
+func (w *quotaWindow) advance(now time.Time) {
+	elapsed := now.Sub(w.start)
+	if elapsed < w.length {
+		return
+	}
+
+	if elapsed < 2*w.length {
+		// the current window becomes the previous window
+		w.prevCount = w.count
+	} else {
+		// both windows have passed without connections
+		w.prevCount = 0
+	}
+	w.count = 0
+	w.start = w.start.Add(elapsed.Truncate(w.length))
+}
+
+// estimate returns the usage over the rolling window ending at now
+func (w *quotaWindow) estimate(now time.Time) float64 {
+	overlap := 1 - float64(now.Sub(w.start))/float64(w.length)
+	return float64(w.prevCount)*overlap + float64(w.count)
+}
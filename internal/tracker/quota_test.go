@@ -0,0 +1,113 @@
+package tracker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDownstreamQuotasTryRecordConnection(t *testing.T) {
+	downstream1 := "downstream1"
+	downstream2 := "downstream2"
+
+	tests := []struct {
+		name string
+		op   func(*DownstreamQuotas, *FakeClock)
+	}{
+		{
+			name: "allow connections up to the quota",
+			op: func(tracker *DownstreamQuotas, clock *FakeClock) {
+				for i := 0; i < 3; i++ {
+					if !tracker.TryRecordConnection(downstream1, 3, time.Hour) {
+						t.Errorf("expected connection %v to be allowed\n", i)
+					}
+				}
+				if tracker.TryRecordConnection(downstream1, 3, time.Hour) {
+					t.Errorf("expected connection beyond quota to be denied\n")
+				}
+				if !tracker.TryRecordConnection(downstream2, 3, time.Hour) {
+					t.Errorf("expected connection for another downstream to be allowed\n")
+				}
+				if usage := tracker.Usage(downstream1); usage != 3 {
+					t.Errorf("expected usage of 3, got %v\n", usage)
+				}
+			},
+		},
+		{
+			name: "previous window counts against the quota while it overlaps",
+			op: func(tracker *DownstreamQuotas, clock *FakeClock) {
+				tracker.TryRecordConnection(downstream1, 2, time.Hour)
+				tracker.TryRecordConnection(downstream1, 2, time.Hour)
+
+				// a window and a quarter pass since the window began,
+				// so three quarters of the previous window still overlap
+				clock.Advance(time.Hour + 15*time.Minute)
+				if usage := tracker.Usage(downstream1); usage != 1 {
+					t.Errorf("expected usage of 1, got %v\n", usage)
+				}
+				if !tracker.TryRecordConnection(downstream1, 2, time.Hour) {
+					t.Errorf("expected connection to be allowed\n")
+				}
+				if tracker.TryRecordConnection(downstream1, 2, time.Hour) {
+					t.Errorf("expected connection to be denied by the previous window\n")
+				}
+			},
+		},
+		{
+			name: "quota is restored once windows have passed",
+			op: func(tracker *DownstreamQuotas, clock *FakeClock) {
+				tracker.TryRecordConnection(downstream1, 2, time.Hour)
+				tracker.TryRecordConnection(downstream1, 2, time.Hour)
+
+				// both windows pass
+				clock.Advance(3 * time.Hour)
+				if usage := tracker.Usage(downstream1); usage != 0 {
+					t.Errorf("expected usage of 0, got %v\n", usage)
+				}
+				for i := 0; i < 2; i++ {
+					if !tracker.TryRecordConnection(downstream1, 2, time.Hour) {
+						t.Errorf("expected connection %v to be allowed\n", i)
+					}
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		clock := NewFakeClock(time.Now())
+		tracker := NewDownstreamQuotas()
+		tracker.SetClock(clock)
+		test.op(tracker, clock)
+	}
+}
+
+func TestDownstreamQuotasRemoveIdle(t *testing.T) {
+	downstream1 := "downstream1"
+	downstream2 := "downstream2"
+
+	clock := NewFakeClock(time.Now())
+	tracker := NewDownstreamQuotas()
+	tracker.SetClock(clock)
+	tracker.TryRecordConnection(downstream1, 2, time.Minute)
+	tracker.TryRecordConnection(downstream2, 2, time.Hour)
+
+	// neither downstream has been idle for the ttl
+	tracker.RemoveIdle(time.Minute)
+	if len(tracker.windows) != 2 {
+		t.Errorf("expected 2 windows to be tracked, got %v\n", len(tracker.windows))
+	}
+
+	// the windows of downstream1 have passed, but downstream2 still holds a connection
+	clock.Advance(5 * time.Minute)
+	tracker.RemoveIdle(time.Minute)
+	if _, ok := tracker.windows[downstream1]; ok {
+		t.Errorf("expected empty window of downstream1 to be removed\n")
+	}
+	if _, ok := tracker.windows[downstream2]; !ok {
+		t.Errorf("expected window of downstream2 to be kept\n")
+	}
+
+	// removed downstreams start a new count
+	if !tracker.TryRecordConnection(downstream1, 1, time.Minute) {
+		t.Errorf("expected connection to be allowed\n")
+	}
+}
@@ -0,0 +1,122 @@
+package tracker
+
+import (
+	"sync"
+	"time"
+)
+
+// DownstreamRates limits the rate of new connections per downstream
+// based on a unique string identifier.
+// Each downstream is given a token bucket which refills at a steady rate
+// and can hold up to a burst of tokens.
+// DownstreamRates is safe for concurrent use.
+type DownstreamRates struct {
+	// mu protects the resources of DownstreamRates
+	mu sync.Mutex
+
+	// buckets is a map of downstreamID to a token bucket
+	buckets map[string]*tokenBucket
+
+	// clock provides the time used to refill buckets
+	clock Clock
+}
+
+// A tokenBucket stores the tokens available to a downstream
+// and when they were last refilled.
+type tokenBucket struct {
+	// tokens is the number of connections which can currently be started.
+	// Partial tokens accumulate between refills.
+	tokens float64
+
+	// last is the time at which tokens was last refilled
+	last time.Time
+
+	// perSecond and burst are the refill rate and capacity
+	// the bucket was last taken from with
+	perSecond float64
+	burst     uint32
+}
+
+// NewDownstreamRates initializes and returns a DownstreamRates
+func NewDownstreamRates() *DownstreamRates {
+	return &DownstreamRates{
+		buckets: map[string]*tokenBucket{},
+		clock:   systemClock{},
+	}
+}
+
+// SetClock replaces the Clock used by DownstreamRates,
+// and must be called before DownstreamRates is used.
+func (t *DownstreamRates) SetClock(clock Clock) {
+	t.clock = clock
+}
+
+// TryTake checks if a downstreamID has a token available and if so takes it.
+// Tokens are refilled at perSecond, up to a maximum of burst.
+// If the downstream has no history, a new full bucket will be started.
+// perSecond must be positive, otherwise the connection is not allowed.
+// The return indicates if the new connection should be allowed.
+func (t *DownstreamRates) TryTake(downstreamID string, perSecond float64, burst uint32) bool {
+	if !(perSecond > 0) {
+		// also catches NaN, which would otherwise drain tokens without bound
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	bucket, ok := t.buckets[downstreamID]
+	if !ok {
+		bucket = &tokenBucket{
+			tokens: float64(burst),
+			last:   now,
+		}
+		t.buckets[downstreamID] = bucket
+	}
+	bucket.perSecond = perSecond
+	bucket.burst = burst
+	bucket.refill(now)
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// RemoveIdle stops tracking downstreams which have not taken a token for at least ttl
+// and whose buckets have refilled to burst. Such a bucket is no different from
+// the full bucket a downstream with no history is given, so no limit is lost.
+// RemoveIdle is intended to be called periodically, so that downstreams
+// which are no longer connecting don't accumulate forever.
+func (t *DownstreamRates) RemoveIdle(ttl time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	for downstreamID, bucket := range t.buckets {
+		if now.Sub(bucket.last) < ttl {
+			continue
+		}
+		bucket.refill(now)
+		if bucket.tokens < float64(bucket.burst) {
+			continue
+		}
+		delete(t.buckets, downstreamID)
+	}
+}
+
+// refill adds the tokens earned since the last refill, without exceeding burst
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last)
+	b.last = now
+	if elapsed <= 0 {
+		return
+	}
+
+	b.tokens += elapsed.Seconds() * b.perSecond
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+}
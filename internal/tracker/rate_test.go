@@ -0,0 +1,122 @@
+package tracker
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDownstreamRatesTryTake(t *testing.T) {
+	downstream1 := "downstream1"
+	downstream2 := "downstream2"
+
+	tests := []struct {
+		name string
+		op   func(*DownstreamRates, *FakeClock)
+	}{
+		{
+			name: "allow connections up to burst",
+			op: func(tracker *DownstreamRates, clock *FakeClock) {
+				for i := 0; i < 3; i++ {
+					if !tracker.TryTake(downstream1, 1, 3) {
+						t.Errorf("expected connection %v to be allowed\n", i)
+					}
+				}
+				if tracker.TryTake(downstream1, 1, 3) {
+					t.Errorf("expected connection beyond burst to be denied\n")
+				}
+			},
+		},
+		{
+			name: "downstreams have separate buckets",
+			op: func(tracker *DownstreamRates, clock *FakeClock) {
+				if !tracker.TryTake(downstream1, 1, 1) {
+					t.Errorf("expected connection to be allowed\n")
+				}
+				if !tracker.TryTake(downstream2, 1, 1) {
+					t.Errorf("expected connection to be allowed\n")
+				}
+				if tracker.TryTake(downstream1, 1, 1) {
+					t.Errorf("expected connection beyond burst to be denied\n")
+				}
+			},
+		},
+		{
+			name: "refill tokens over time, without exceeding burst",
+			op: func(tracker *DownstreamRates, clock *FakeClock) {
+				tracker.TryTake(downstream1, 10, 2)
+				tracker.TryTake(downstream1, 10, 2)
+				if tracker.TryTake(downstream1, 10, 2) {
+					t.Errorf("expected connection beyond burst to be denied\n")
+				}
+
+				clock.Advance(time.Hour)
+				for i := 0; i < 2; i++ {
+					if !tracker.TryTake(downstream1, 10, 2) {
+						t.Errorf("expected connection %v to be allowed after refill\n", i)
+					}
+				}
+				if tracker.TryTake(downstream1, 10, 2) {
+					t.Errorf("expected connection beyond burst to be denied after refill\n")
+				}
+			},
+		},
+		{
+			name: "deny connections without a positive rate",
+			op: func(tracker *DownstreamRates, clock *FakeClock) {
+				for _, perSecond := range []float64{0, -1, math.NaN()} {
+					if tracker.TryTake(downstream1, perSecond, 2) {
+						t.Errorf("expected connection with a rate of %v to be denied\n", perSecond)
+					}
+				}
+				if len(tracker.buckets) != 0 {
+					t.Errorf("expected no buckets to be started, got %v\n", len(tracker.buckets))
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		clock := NewFakeClock(time.Now())
+		tracker := NewDownstreamRates()
+		tracker.SetClock(clock)
+		test.op(tracker, clock)
+	}
+}
+
+func TestDownstreamRatesRemoveIdle(t *testing.T) {
+	downstream1 := "downstream1"
+	downstream2 := "downstream2"
+
+	clock := NewFakeClock(time.Now())
+	tracker := NewDownstreamRates()
+	tracker.SetClock(clock)
+	tracker.TryTake(downstream1, 1, 2)
+	tracker.TryTake(downstream2, 0.001, 2)
+
+	// neither downstream has been idle for the ttl
+	tracker.RemoveIdle(time.Minute)
+	if len(tracker.buckets) != 2 {
+		t.Errorf("expected 2 buckets to be tracked, got %v\n", len(tracker.buckets))
+	}
+
+	// downstream1 has refilled, but downstream2 is still below burst
+	clock.Advance(2 * time.Minute)
+	tracker.RemoveIdle(time.Minute)
+	if _, ok := tracker.buckets[downstream1]; ok {
+		t.Errorf("expected refilled bucket of downstream1 to be removed\n")
+	}
+	if _, ok := tracker.buckets[downstream2]; !ok {
+		t.Errorf("expected partially refilled bucket of downstream2 to be kept\n")
+	}
+
+	// removed downstreams start a new full bucket
+	for i := 0; i < 2; i++ {
+		if !tracker.TryTake(downstream1, 1, 2) {
+			t.Errorf("expected connection %v to be allowed\n", i)
+		}
+	}
+	if tracker.TryTake(downstream1, 1, 2) {
+		t.Errorf("expected connection beyond burst to be denied\n")
+	}
+}
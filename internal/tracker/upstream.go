@@ -4,12 +4,21 @@ import (
 	"container/heap"
 	"errors"
 	"sync"
+	"sync/atomic"
 
 	"github.com/google/uuid"
 )
 
 var errorNoAvailableUpstream = errors.New("No Available Upstream")
 
+var errorGroupAtCapacity = errors.New("Upstream Group At Capacity")
+
+var errorUnknownUpstream = errors.New("Unknown Upstream")
+
+var errorInvalidWeight = errors.New("Invalid Upstream Weight")
+
+var errorDrainCancelled = errors.New("Upstream Drain Cancelled")
+
 // UpstreamConns tracks connections for an upstreamGroup
 // on a per upstream basis. Upstreams can be marked as
 // unhealthy to prevent them from being chosen for new connections.
@@ -21,180 +30,592 @@ type UpstreamConns struct {
 	// upstreams holds all upstreams, healthy or unhealthy
 	upstreams map[uuid.UUID]*upstream
 
+	// conns is the count of connections per upstream.
+	// Every tracked upstream has a count, even if it is 0.
+	conns counts[uuid.UUID]
+
 	// pq holds healthy upstreams and provides the means to
 	// pick the upstream with the least connections.
 	pq *upstreamPQ
+
+	// total is the count of connections across all upstreams.
+	// Its max is the groupMax.
+	total connTotal
+
+	// hooks are called as connections and availability change
+	hooks atomic.Pointer[UpstreamHooks]
+}
+
+// UpstreamHooks are optional callbacks which allow UpstreamConns to be observed,
+// for example by metrics, without the tracker depending on them.
+// Hooks are called synchronously from the goroutine which made the change,
+// after UpstreamConns has been unlocked, so they should be quick. Any hook may be nil.
+type UpstreamHooks struct {
+	// OnRecord is called when a connection to an upstream is recorded
+	OnRecord func(id uuid.UUID)
+
+	// OnEnd is called when a connection to an upstream is ended
+	OnEnd func(id uuid.UUID)
+
+	// OnReject is called with the reason a new connection could not be given an upstream
+	OnReject func(err error)
+
+	// OnAvailabilityChange is called when an upstream is added to
+	// or removed from the upstreams available for new connections
+	OnAvailabilityChange func(id uuid.UUID, available bool)
 }
 
-// An upstream stores a count of connections
+// An upstream stores the state of an upstream
 // as well as some overhead for use in upstreamPQ.
+// Its count of connections is kept by UpstreamConns.conns.
 type upstream struct {
 	// id is the id of the upstream
 	id uuid.UUID
 
-	// The count of connections to the upstream.
-	// Also the priority of an upstream, lowest first.
-	connCount uint32
+	// weight is the relative share of connections the upstream should receive.
+	// The count of connections divided by weight is the priority of an upstream, lowest first.
+	// weight is never 0.
+	weight uint32
+
+	// bytesSent is the count of bytes proxied to the upstream
+	bytesSent uint64
+
+	// bytesReceived is the count of bytes proxied from the upstream
+	bytesReceived uint64
 
 	// The index is needed by update and is maintained by the heap.Interface methods.
 	// if an upstream is pulled from the upstreamPQ (because of health)
 	// its index will be set to -1
 	index int
+
+	// removed indicates the upstream has been removed with RemoveUpstream
+	// but still has connections which have not ended.
+	// removed upstreams are never returned to the upstreamPQ.
+	removed bool
+
+	// healthy is the last availability reported by
+	// UpstreamAvailable and UpstreamUnavailable.
+	healthy bool
+
+	// draining indicates the upstream is draining after DrainUpstream.
+	// draining upstreams are never returned to the upstreamPQ.
+	draining bool
+
+	// drainWaiters are the channels returned by DrainUpstream
+	// which have not yet been sent the result of draining.
+	drainWaiters []chan error
 }
 
 // NewUpstreamConns creates a new UpstreamConns
-// with upstreams based on provided upstreamIDs.
+// with upstreams based on provided upstreamIDs, each with a weight of 1.
 // upstreams must be marked as healthy before they will be
 // added to the internal priorityQueue and available for BeginConnection()
-func NewUpstreamConns(upstreamIDs []uuid.UUID) *UpstreamConns {
+// groupMax limits connections across all upstreams, a groupMax of 0 disables the limit.
+func NewUpstreamConns(upstreamIDs []uuid.UUID, groupMax uint32) *UpstreamConns {
 	upstreams := make(map[uuid.UUID]*upstream, len(upstreamIDs))
+	conns := make(counts[uuid.UUID], len(upstreamIDs))
 	for _, id := range upstreamIDs {
 		upstreams[id] = &upstream{
-			id:    id,
-			index: -1,
+			id:     id,
+			weight: 1,
+			index:  -1,
 		}
+		conns[id] = 0
 	}
-	return &UpstreamConns{
+	t := &UpstreamConns{
 		upstreams: upstreams,
-		pq:        &upstreamPQ{},
+		conns:     conns,
+		pq: &upstreamPQ{
+			upstreams: []*upstream{},
+			conns:     conns,
+		},
 	}
+	t.total.max = groupMax
+	return t
 }
 
 // NextAvailableUpstream returns the UUID of the upstream with the least connections
 // and records the additional connection.
 // An error is returned if there are no available upstreams
+// or if the group is already at its groupMax
 func (t *UpstreamConns) NextAvailableUpstream() (uuid.UUID, error) {
+	return t.NextAvailableUpstreamWithHeadroom(0)
+}
+
+// NextAvailableUpstreamWithHeadroom is NextAvailableUpstream for low priority connections.
+// errorGroupAtCapacity is returned unless the connection leaves at least headroom
+// connections beneath the groupMax, so that the last connections are kept for
+// higher priority connections, which use NextAvailableUpstream.
+// headroom has no effect if there is no groupMax.
+func (t *UpstreamConns) NextAvailableUpstreamWithHeadroom(headroom uint32) (uuid.UUID, error) {
+	id, err := t.nextAvailableUpstream(headroom)
+
+	hooks := t.hooks.Load()
+	if hooks == nil {
+		return id, err
+	}
+	if err == nil && hooks.OnRecord != nil {
+		hooks.OnRecord(id)
+	}
+	if err != nil && hooks.OnReject != nil {
+		hooks.OnReject(err)
+	}
+	return id, err
+}
+
+// nextAvailableUpstream is NextAvailableUpstreamWithHeadroom without calling hooks
+func (t *UpstreamConns) nextAvailableUpstream(headroom uint32) (uuid.UUID, error) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
+	if !t.total.reserve(headroom) {
+		return uuid.UUID{}, errorGroupAtCapacity
+	}
+
 	upstream := t.pq.peek()
 	if upstream == nil {
+		t.total.release()
 		return uuid.UUID{}, errorNoAvailableUpstream
 	}
 
 	// do we need a check for an upstream which is not in the upstreamPQ?
 	// The assumption is that we are only incrementing upstreams which are
 	// healthy and in the upstreamPQ. unhealthy upstreams are removed from the upstreamPQ.
-	upstream.connCount++
+	t.conns.increment(upstream.id)
 	heap.Fix(t.pq, upstream.index)
 	return upstream.id, nil
 }
 
 // ConnectionEnded takes the UUID of the upstream which has
 // just had a connection terminate and records the ended connection.
-func (t *UpstreamConns) ConnectionEnded(id uuid.UUID) {
+// An error is returned if the upstream is unknown or has no connections to end.
+func (t *UpstreamConns) ConnectionEnded(id uuid.UUID) error {
+	if err := t.connectionEnded(id); err != nil {
+		return err
+	}
+	if hooks := t.hooks.Load(); hooks != nil && hooks.OnEnd != nil {
+		hooks.OnEnd(id)
+	}
+	return nil
+}
+
+// connectionEnded is ConnectionEnded without calling hooks
+func (t *UpstreamConns) connectionEnded(id uuid.UUID) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
 	upstream, ok := t.upstreams[id]
 	if !ok {
-		// id was not found
-		return
+		return errorUnknownUpstream
+	}
+	remaining, err := t.conns.decrement(id)
+	if err != nil {
+		return err
+	}
+	t.total.release()
+
+	if remaining == 0 {
+		upstream.finishDrain(nil)
+	}
+
+	if upstream.removed && remaining == 0 {
+		// upstream has finished draining
+		delete(t.upstreams, id)
+		delete(t.conns, id)
+		return nil
 	}
-	upstream.connCount--
 
 	if upstream.index < 0 {
 		// upstream is not in the upstreamPQ
-		return
+		return nil
 	}
 
 	heap.Fix(t.pq, upstream.index)
+	return nil
 }
 
 // UpstreamUnavailable is used to remove an upstream from the available upstreams
-func (t *UpstreamConns) UpstreamUnavailable(id uuid.UUID) {
+// An error is returned if the upstream is unknown.
+func (t *UpstreamConns) UpstreamUnavailable(id uuid.UUID) error {
+	changed, err := t.upstreamUnavailable(id)
+	if changed {
+		t.observeAvailability(id, false)
+	}
+	return err
+}
+
+// upstreamUnavailable is UpstreamUnavailable without calling hooks.
+// The return indicates if the upstream was made unavailable.
+func (t *UpstreamConns) upstreamUnavailable(id uuid.UUID) (bool, error) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
 	upstream, ok := t.upstreams[id]
 	if !ok {
-		// id was not found
-		return
+		return false, errorUnknownUpstream
 	}
+	upstream.healthy = false
 
 	if upstream.index < 0 {
 		// upstream is not in the upstreamPQ
 		// generally should not be likely, but possible
-		return
+		return false, nil
 	}
 
 	t.pq.remove(upstream)
+	return true, nil
 }
 
 // UpstreamAvailable is used to restore an upstream to the available upstreams
-func (t *UpstreamConns) UpstreamAvailable(id uuid.UUID) {
+// An error is returned if the upstream is unknown.
+func (t *UpstreamConns) UpstreamAvailable(id uuid.UUID) error {
+	changed, err := t.upstreamAvailable(id)
+	if changed {
+		t.observeAvailability(id, true)
+	}
+	return err
+}
+
+// upstreamAvailable is UpstreamAvailable without calling hooks.
+// The return indicates if the upstream was made available.
+func (t *UpstreamConns) upstreamAvailable(id uuid.UUID) (bool, error) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
 	upstream, ok := t.upstreams[id]
 	if !ok {
-		// id was not found
-		return
+		return false, errorUnknownUpstream
+	}
+	upstream.healthy = true
+
+	if upstream.removed || upstream.draining {
+		// upstream is draining and should not receive new connections
+		return false, nil
 	}
 
 	if upstream.index > -1 {
 		// upstream is in the upstreamPQ
 		// generally should not be likely, but possible
+		return false, nil
+	}
+
+	heap.Push(t.pq, upstream)
+	return true, nil
+}
+
+// AddUpstream is used to begin tracking a new upstream.
+// Like upstreams provided to NewUpstreamConns, the upstream must be marked
+// as healthy with UpstreamAvailable before it is available for new connections.
+// Adding an upstream which is draining after RemoveUpstream cancels the removal.
+func (t *UpstreamConns) AddUpstream(id uuid.UUID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if up, ok := t.upstreams[id]; ok {
+		up.removed = false
 		return
 	}
 
+	t.upstreams[id] = &upstream{
+		id:     id,
+		weight: 1,
+		index:  -1,
+	}
+	t.conns[id] = 0
+}
+
+// RemoveUpstream is used to stop tracking an upstream.
+// The upstream is immediately removed from the available upstreams.
+// If the upstream still has connections, it is kept until
+// ConnectionEnded has been called for each of them.
+// An error is returned if the upstream is unknown.
+func (t *UpstreamConns) RemoveUpstream(id uuid.UUID) error {
+	changed, err := t.removeUpstream(id)
+	if changed {
+		t.observeAvailability(id, false)
+	}
+	return err
+}
+
+// removeUpstream is RemoveUpstream without calling hooks.
+// The return indicates if the upstream was made unavailable.
+func (t *UpstreamConns) removeUpstream(id uuid.UUID) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	upstream, ok := t.upstreams[id]
+	if !ok {
+		return false, errorUnknownUpstream
+	}
+
+	changed := upstream.index > -1
+	if changed {
+		t.pq.remove(upstream)
+	}
+
+	if t.conns[id] == 0 {
+		delete(t.upstreams, id)
+		delete(t.conns, id)
+		return changed, nil
+	}
+	upstream.removed = true
+	return changed, nil
+}
+
+// RecordBytes adds to the counts of bytes proxied to and from an upstream.
+// An error is returned if the upstream is unknown.
+func (t *UpstreamConns) RecordBytes(id uuid.UUID, sent, received uint64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	upstream, ok := t.upstreams[id]
+	if !ok {
+		return errorUnknownUpstream
+	}
+	upstream.bytesSent += sent
+	upstream.bytesReceived += received
+	return nil
+}
+
+// SetUpstreamWeight is used to change the relative share of connections an upstream receives.
+// Upstreams are chosen by the least connections per weight,
+// so an upstream with a weight of 2 receives twice the connections of one with a weight of 1.
+// An error is returned if the upstream is unknown or the weight is 0.
+func (t *UpstreamConns) SetUpstreamWeight(id uuid.UUID, weight uint32) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if weight == 0 {
+		return errorInvalidWeight
+	}
+
+	upstream, ok := t.upstreams[id]
+	if !ok {
+		return errorUnknownUpstream
+	}
+	upstream.weight = weight
+
+	if upstream.index < 0 {
+		// upstream is not in the upstreamPQ
+		return nil
+	}
+
+	heap.Fix(t.pq, upstream.index)
+	return nil
+}
+
+// DrainUpstream is used to remove an upstream from the available upstreams
+// without marking it unhealthy. A draining upstream is not restored by
+// UpstreamAvailable, only by UndrainUpstream.
+// The returned channel receives the result of draining and is then closed,
+// so callers can wait for existing connections to finish, or give up at a deadline.
+// The result is nil once the upstream has no connections,
+// or errorDrainCancelled if UndrainUpstream is called first.
+// An error is returned if the upstream is unknown.
+func (t *UpstreamConns) DrainUpstream(id uuid.UUID) (<-chan error, error) {
+	drained, changed, err := t.drainUpstream(id)
+	if changed {
+		t.observeAvailability(id, false)
+	}
+	return drained, err
+}
+
+// drainUpstream is DrainUpstream without calling hooks.
+// The bool returned indicates if the upstream was made unavailable.
+func (t *UpstreamConns) drainUpstream(id uuid.UUID) (<-chan error, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	upstream, ok := t.upstreams[id]
+	if !ok {
+		return nil, false, errorUnknownUpstream
+	}
+
+	// each caller is given its own channel, so every caller receives the result
+	drained := make(chan error, 1)
+	upstream.drainWaiters = append(upstream.drainWaiters, drained)
+	upstream.draining = true
+
+	changed := upstream.index > -1
+	if changed {
+		t.pq.remove(upstream)
+	}
+
+	if t.conns[id] == 0 {
+		upstream.finishDrain(nil)
+	}
+	return drained, changed, nil
+}
+
+// UndrainUpstream is used to end draining an upstream.
+// Channels returned by DrainUpstream which have not yet received
+// a result receive errorDrainCancelled.
+// If the upstream is healthy it is restored to the available upstreams.
+// An error is returned if the upstream is unknown.
+func (t *UpstreamConns) UndrainUpstream(id uuid.UUID) error {
+	changed, err := t.undrainUpstream(id)
+	if changed {
+		t.observeAvailability(id, true)
+	}
+	return err
+}
+
+// undrainUpstream is UndrainUpstream without calling hooks.
+// The return indicates if the upstream was made available.
+func (t *UpstreamConns) undrainUpstream(id uuid.UUID) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	upstream, ok := t.upstreams[id]
+	if !ok {
+		return false, errorUnknownUpstream
+	}
+	upstream.finishDrain(errorDrainCancelled)
+	upstream.draining = false
+
+	if !upstream.healthy || upstream.removed || upstream.index > -1 {
+		return false, nil
+	}
+
 	heap.Push(t.pq, upstream)
+	return true, nil
+}
+
+// finishDrain sends err to, and closes, the channels returned by DrainUpstream
+// which have not yet received a result.
+func (up *upstream) finishDrain(err error) {
+	for _, drained := range up.drainWaiters {
+		drained <- err
+		close(drained)
+	}
+	up.drainWaiters = nil
+}
+
+// SetHooks replaces the hooks called by UpstreamConns.
+func (t *UpstreamConns) SetHooks(hooks UpstreamHooks) {
+	t.hooks.Store(&hooks)
+}
+
+// observeAvailability calls OnAvailabilityChange
+func (t *UpstreamConns) observeAvailability(id uuid.UUID, available bool) {
+	if hooks := t.hooks.Load(); hooks != nil && hooks.OnAvailabilityChange != nil {
+		hooks.OnAvailabilityChange(id, available)
+	}
+}
+
+// UpstreamSnapshot is a copy of the state of an upstream at a point in time
+type UpstreamSnapshot struct {
+	// ConnCount is the count of connections to the upstream
+	ConnCount uint32
+
+	// Weight is the relative share of connections the upstream receives
+	Weight uint32
+
+	// BytesSent is the count of bytes proxied to the upstream
+	BytesSent uint64
+
+	// BytesReceived is the count of bytes proxied from the upstream
+	BytesReceived uint64
+
+	// Healthy is the last availability reported by
+	// UpstreamAvailable and UpstreamUnavailable
+	Healthy bool
+
+	// Available indicates the upstream can be chosen for new connections
+	Available bool
+
+	// Draining indicates the upstream is draining,
+	// either after DrainUpstream or RemoveUpstream
+	Draining bool
+}
+
+// Snapshot returns a copy of the state of every tracked upstream, by id.
+func (t *UpstreamConns) Snapshot() map[uuid.UUID]UpstreamSnapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	snapshot := make(map[uuid.UUID]UpstreamSnapshot, len(t.upstreams))
+	for id, upstream := range t.upstreams {
+		snapshot[id] = UpstreamSnapshot{
+			ConnCount:     t.conns[id],
+			Weight:        upstream.weight,
+			BytesSent:     upstream.bytesSent,
+			BytesReceived: upstream.bytesReceived,
+			Healthy:       upstream.healthy,
+			Available:     upstream.index > -1,
+			Draining:      upstream.removed || upstream.draining,
+		}
+	}
+	return snapshot
+}
+
+// TotalConns returns the count of connections across all upstreams
+func (t *UpstreamConns) TotalConns() uint32 {
+	return t.total.load()
 }
 
 // A upstreamPQ implements heap.Interface and holds upstreams.
-type upstreamPQ []*upstream
+type upstreamPQ struct {
+	// upstreams is the heap of upstreams
+	upstreams []*upstream
+
+	// conns is the count of connections per upstream,
+	// shared with UpstreamConns, by which upstreams are ordered.
+	conns counts[uuid.UUID]
+}
 
 var _ heap.Interface = (*upstreamPQ)(nil)
 
-func (pq upstreamPQ) Len() int { return len(pq) }
+func (pq *upstreamPQ) Len() int { return len(pq.upstreams) }
 
-func (pq upstreamPQ) Less(i, j int) bool {
-	// We want Pop to give us the highest, not lowest, priority so we use greater than here.
-	return pq[i].connCount < pq[j].connCount
+func (pq *upstreamPQ) Less(i, j int) bool {
+	// Compare connCount/weight, cross multiplied to avoid division.
+	upI, upJ := pq.upstreams[i], pq.upstreams[j]
+	return uint64(pq.conns[upI.id])*uint64(upJ.weight) < uint64(pq.conns[upJ.id])*uint64(upI.weight)
 }
 
-func (pq upstreamPQ) Swap(i, j int) {
-	pq[i], pq[j] = pq[j], pq[i]
-	pq[i].index = i
-	pq[j].index = j
+func (pq *upstreamPQ) Swap(i, j int) {
+	pq.upstreams[i], pq.upstreams[j] = pq.upstreams[j], pq.upstreams[i]
+	pq.upstreams[i].index = i
+	pq.upstreams[j].index = j
 }
 
 func (pq *upstreamPQ) Push(x any) {
-	n := len(*pq)
+	n := len(pq.upstreams)
 	item := x.(*upstream)
 	item.index = n
-	*pq = append(*pq, item)
+	pq.upstreams = append(pq.upstreams, item)
 }
 
 func (pq *upstreamPQ) Pop() any {
-	old := *pq
+	old := pq.upstreams
 	n := len(old)
 	item := old[n-1]
 	old[n-1] = nil  // avoid memory leak
 	item.index = -1 // for safety
-	*pq = old[0 : n-1]
+	pq.upstreams = old[0 : n-1]
 	return item
 }
 
 // peek returns the upstream at the front of the upstreamPQ without altering or moving it
 func (pq *upstreamPQ) peek() *upstream {
-	if len(*pq) == 0 {
+	if len(pq.upstreams) == 0 {
 		return nil
 	}
-	return (*pq)[0]
+	return pq.upstreams[0]
 }
 
 // remove pulls an upstream from the upstreamPQ.
 // remove assumes that up is in the upstreamPQ
 func (pq *upstreamPQ) remove(up *upstream) {
-	if len(*pq) == 1 {
+	if len(pq.upstreams) == 1 {
 		// up is the only item in the upstreamPQ
 		pq.Pop()
 		return
 	}
 
 	i := up.index
-	j := len(*pq) - 1
+	j := len(pq.upstreams) - 1
 	if i == j {
 		// up is the last item in the upstreamPQ
 		pq.Pop()
@@ -5,6 +5,7 @@ import (
 	"reflect"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -12,13 +13,14 @@ import (
 func TestUpstreamConnsCounts(t *testing.T) {
 	upstream1 := uuid.New()
 	upstream2 := uuid.New()
+	upstream3 := uuid.New()
 
 	tests := []struct {
-		name              string
-		op                func(*UpstreamConns)
-		expectedUpstreams map[uuid.UUID]*upstream
+		name          string
+		op            func(*UpstreamConns)
+		expectedConns map[uuid.UUID]uint32
 		// expectedPQ is only checked against if it is non-nil
-		expectedPQ *upstreamPQ
+		expectedPQ []*upstream
 	}{
 		{
 			name: "multiple routines requesting connections",
@@ -49,15 +51,9 @@ func TestUpstreamConnsCounts(t *testing.T) {
 				}
 				wg.Wait()
 			},
-			expectedUpstreams: map[uuid.UUID]*upstream{
-				upstream1: {
-					id:        upstream1,
-					connCount: 5,
-				},
-				upstream2: {
-					id:        upstream2,
-					connCount: 5,
-				},
+			expectedConns: map[uuid.UUID]uint32{
+				upstream1: 5,
+				upstream2: 5,
 			},
 		},
 		{
@@ -74,20 +70,16 @@ func TestUpstreamConnsCounts(t *testing.T) {
 					t.Errorf("unexpected error: %v\n", err)
 				}
 			},
-			expectedUpstreams: map[uuid.UUID]*upstream{
-				upstream1: {
-					id:        upstream1,
-					connCount: 1,
-				},
-				upstream2: {
-					id: upstream2,
-				},
+			expectedConns: map[uuid.UUID]uint32{
+				upstream1: 1,
+				upstream2: 0,
 			},
-			expectedPQ: &upstreamPQ{
+			expectedPQ: []*upstream{
 				{
-					id:        upstream1,
-					connCount: 1,
-					index:     0,
+					id:      upstream1,
+					weight:  1,
+					index:   0,
+					healthy: true,
 				},
 			},
 		},
@@ -111,49 +103,408 @@ func TestUpstreamConnsCounts(t *testing.T) {
 				_, err = tracker.NextAvailableUpstream()
 				failIfNotNil(t, err)
 			},
-			expectedUpstreams: map[uuid.UUID]*upstream{
-				upstream1: {
-					id:        upstream1,
-					connCount: 2,
+			expectedConns: map[uuid.UUID]uint32{
+				upstream1: 2,
+				upstream2: 3,
+			},
+			expectedPQ: []*upstream{
+				{
+					id:      upstream1,
+					weight:  1,
+					index:   0,
+					healthy: true,
 				},
-				upstream2: {
-					id:        upstream2,
-					connCount: 3,
+				{
+					id:      upstream2,
+					weight:  1,
+					index:   1,
+					healthy: true,
 				},
 			},
-			expectedPQ: &upstreamPQ{
+		},
+		{
+			name: "added upstreams are available once marked healthy",
+			op: func(tracker *UpstreamConns) {
+				tracker.AddUpstream(upstream3)
+				tracker.UpstreamAvailable(upstream3)
+				_, err := tracker.NextAvailableUpstream()
+				failIfNotNil(t, err)
+			},
+			expectedConns: map[uuid.UUID]uint32{
+				upstream1: 0,
+				upstream2: 0,
+				upstream3: 1,
+			},
+		},
+		{
+			name: "removed upstreams drain before being forgotten",
+			op: func(tracker *UpstreamConns) {
+				tracker.UpstreamAvailable(upstream1)
+				tracker.UpstreamAvailable(upstream2)
+				_, err := tracker.NextAvailableUpstream()
+				failIfNotNil(t, err)
+				_, err = tracker.NextAvailableUpstream()
+				failIfNotNil(t, err)
+
+				tracker.RemoveUpstream(upstream1)
+				if _, ok := tracker.upstreams[upstream1]; !ok {
+					t.Errorf("expected upstream with connections to be kept while draining\n")
+				}
+
+				// draining upstreams can't be made available again
+				tracker.UpstreamAvailable(upstream1)
+				id, err := tracker.NextAvailableUpstream()
+				failIfNotNil(t, err)
+				if id != upstream2 {
+					t.Errorf("expected upstream2 to be chosen, got %v\n", id)
+				}
+
+				tracker.ConnectionEnded(upstream1)
+			},
+			expectedConns: map[uuid.UUID]uint32{
+				upstream2: 2,
+			},
+			expectedPQ: []*upstream{
+				{
+					id:      upstream2,
+					weight:  1,
+					index:   0,
+					healthy: true,
+				},
+			},
+		},
+		{
+			name: "draining upstreams are not restored by health",
+			op: func(tracker *UpstreamConns) {
+				tracker.UpstreamAvailable(upstream1)
+				tracker.UpstreamAvailable(upstream2)
+				_, err := tracker.NextAvailableUpstream()
+				failIfNotNil(t, err)
+				_, err = tracker.NextAvailableUpstream()
+				failIfNotNil(t, err)
+
+				drained, err := tracker.DrainUpstream(upstream1)
+				failIfNotNil(t, err)
+				tracker.UpstreamUnavailable(upstream1)
+				tracker.UpstreamAvailable(upstream1)
+				_, err = tracker.NextAvailableUpstream()
+				failIfNotNil(t, err)
+
+				select {
+				case <-drained:
+					t.Errorf("expected upstream with connections to still be draining\n")
+				default:
+				}
+				tracker.ConnectionEnded(upstream1)
+				select {
+				case err := <-drained:
+					failIfNotNil(t, err)
+				default:
+					t.Errorf("expected upstream without connections to be drained\n")
+				}
+
+				tracker.UndrainUpstream(upstream1)
+				_, err = tracker.NextAvailableUpstream()
+				failIfNotNil(t, err)
+			},
+			expectedConns: map[uuid.UUID]uint32{
+				upstream1: 1,
+				upstream2: 2,
+			},
+			expectedPQ: []*upstream{
 				{
-					id:        upstream1,
-					connCount: 2,
-					index:     0,
+					id:      upstream1,
+					weight:  1,
+					index:   0,
+					healthy: true,
 				},
 				{
-					id:        upstream2,
-					connCount: 3,
-					index:     1,
+					id:      upstream2,
+					weight:  1,
+					index:   1,
+					healthy: true,
+				},
+			},
+		},
+		{
+			name: "undraining an upstream tells waiters draining was cancelled",
+			op: func(tracker *UpstreamConns) {
+				tracker.UpstreamAvailable(upstream1)
+				_, err := tracker.NextAvailableUpstream()
+				failIfNotNil(t, err)
+
+				drained1, err := tracker.DrainUpstream(upstream1)
+				failIfNotNil(t, err)
+				drained2, err := tracker.DrainUpstream(upstream1)
+				failIfNotNil(t, err)
+				failIfNotNil(t, tracker.UndrainUpstream(upstream1))
+				for _, drained := range []<-chan error{drained1, drained2} {
+					select {
+					case err := <-drained:
+						if !errors.Is(err, errorDrainCancelled) {
+							t.Errorf("expected error %v, but got %v\n", errorDrainCancelled, err)
+						}
+					case <-time.After(time.Second):
+						t.Errorf("expected waiters to be released when draining is cancelled\n")
+					}
+				}
+			},
+			expectedConns: map[uuid.UUID]uint32{
+				upstream1: 1,
+				upstream2: 0,
+			},
+			expectedPQ: []*upstream{
+				{
+					id:      upstream1,
+					weight:  1,
+					index:   0,
+					healthy: true,
 				},
 			},
 		},
 	}
 
 	for i, test := range tests {
-		tracker := NewUpstreamConns([]uuid.UUID{upstream1, upstream2})
+		tracker := NewUpstreamConns([]uuid.UUID{upstream1, upstream2}, 0)
 		test.op(tracker)
 		actualUpstreams := tracker.upstreams
-		for id, actualUpstream := range actualUpstreams {
-			expectedUpstream := test.expectedUpstreams[id]
-			if expectedUpstream.connCount != actualUpstream.connCount {
-				t.Errorf("test(%v) expectedCounts did not match actualCounts: \n %v != %v\n", i, expectedUpstream.connCount, actualUpstream.connCount)
+		if len(test.expectedConns) != len(actualUpstreams) {
+			t.Errorf("test(%v) expected %v upstreams, but found %v\n", i, len(test.expectedConns), len(actualUpstreams))
+		}
+		if len(tracker.conns) != len(actualUpstreams) {
+			t.Errorf("test(%v) expected a count for each of %v upstreams, but found %v\n", i, len(actualUpstreams), len(tracker.conns))
+		}
+		for id := range actualUpstreams {
+			expectedCount, ok := test.expectedConns[id]
+			if !ok {
+				t.Errorf("test(%v) found unexpected upstream %v\n", i, id)
+				continue
+			}
+			if actualCount := tracker.conns[id]; expectedCount != actualCount {
+				t.Errorf("test(%v) expectedCounts did not match actualCounts: \n %v != %v\n", i, expectedCount, actualCount)
 			}
 		}
 
-		actualPQ := tracker.pq
+		actualPQ := tracker.pq.upstreams
 		if test.expectedPQ != nil && !reflect.DeepEqual(test.expectedPQ, actualPQ) {
 			t.Errorf("test(%v) expectedPQ did not match actualPQ: \n %v != %v\n", i, test.expectedPQ, actualPQ)
 		}
 	}
 }
 
+func TestUpstreamConnsGroupMax(t *testing.T) {
+	upstream1 := uuid.New()
+	upstream2 := uuid.New()
+
+	tracker := NewUpstreamConns([]uuid.UUID{upstream1, upstream2}, 3)
+	tracker.UpstreamAvailable(upstream1)
+	tracker.UpstreamAvailable(upstream2)
+
+	for i := 0; i < 3; i++ {
+		_, err := tracker.NextAvailableUpstream()
+		failIfNotNil(t, err)
+	}
+
+	// this connection should not be recorded because of the group maximum
+	_, err := tracker.NextAvailableUpstream()
+	if !errors.Is(err, errorGroupAtCapacity) {
+		t.Errorf("expected error %v, but got %v\n", errorGroupAtCapacity, err)
+	}
+
+	tracker.ConnectionEnded(upstream1)
+	_, err = tracker.NextAvailableUpstream()
+	failIfNotNil(t, err)
+
+	if total := tracker.total.load(); total != 3 {
+		t.Errorf("expected total of 3, got %v\n", total)
+	}
+}
+
+func TestUpstreamConnsHeadroom(t *testing.T) {
+	upstream1 := uuid.New()
+
+	tracker := NewUpstreamConns([]uuid.UUID{upstream1}, 2)
+	tracker.UpstreamAvailable(upstream1)
+
+	_, err := tracker.NextAvailableUpstreamWithHeadroom(1)
+	failIfNotNil(t, err)
+
+	// the last connection beneath the group maximum is kept for higher priority connections
+	_, err = tracker.NextAvailableUpstreamWithHeadroom(1)
+	if !errors.Is(err, errorGroupAtCapacity) {
+		t.Errorf("expected error %v, but got %v\n", errorGroupAtCapacity, err)
+	}
+	_, err = tracker.NextAvailableUpstream()
+	failIfNotNil(t, err)
+
+	if total := tracker.TotalConns(); total != 2 {
+		t.Errorf("expected total of 2, got %v\n", total)
+	}
+}
+
+func TestUpstreamConnsSnapshot(t *testing.T) {
+	upstream1 := uuid.New()
+	upstream2 := uuid.New()
+	upstream3 := uuid.New()
+
+	tracker := NewUpstreamConns([]uuid.UUID{upstream1, upstream2, upstream3}, 0)
+	tracker.UpstreamAvailable(upstream1)
+	tracker.UpstreamAvailable(upstream2)
+	_, err := tracker.NextAvailableUpstream()
+	failIfNotNil(t, err)
+	_, err = tracker.NextAvailableUpstream()
+	failIfNotNil(t, err)
+	tracker.DrainUpstream(upstream2)
+
+	expectedSnapshot := map[uuid.UUID]UpstreamSnapshot{
+		upstream1: {
+			ConnCount: 1,
+			Weight:    1,
+			Healthy:   true,
+			Available: true,
+		},
+		upstream2: {
+			ConnCount: 1,
+			Weight:    1,
+			Healthy:   true,
+			Draining:  true,
+		},
+		upstream3: {
+			Weight: 1,
+		},
+	}
+	snapshot := tracker.Snapshot()
+	if !reflect.DeepEqual(expectedSnapshot, snapshot) {
+		t.Errorf("expectedSnapshot did not match actualSnapshot: \n %v != %v\n", expectedSnapshot, snapshot)
+	}
+	if total := tracker.TotalConns(); total != 2 {
+		t.Errorf("expected total of 2, got %v\n", total)
+	}
+}
+
+func TestUpstreamConnsUnknownAndUnderflow(t *testing.T) {
+	upstream1 := uuid.New()
+	unknownUpstream := uuid.New()
+
+	tracker := NewUpstreamConns([]uuid.UUID{upstream1}, 0)
+	if err := tracker.UpstreamAvailable(unknownUpstream); !errors.Is(err, errorUnknownUpstream) {
+		t.Errorf("expected error %v, but got %v\n", errorUnknownUpstream, err)
+	}
+	if err := tracker.UpstreamUnavailable(unknownUpstream); !errors.Is(err, errorUnknownUpstream) {
+		t.Errorf("expected error %v, but got %v\n", errorUnknownUpstream, err)
+	}
+	if err := tracker.ConnectionEnded(unknownUpstream); !errors.Is(err, errorUnknownUpstream) {
+		t.Errorf("expected error %v, but got %v\n", errorUnknownUpstream, err)
+	}
+	if _, err := tracker.DrainUpstream(unknownUpstream); !errors.Is(err, errorUnknownUpstream) {
+		t.Errorf("expected error %v, but got %v\n", errorUnknownUpstream, err)
+	}
+	if err := tracker.UndrainUpstream(unknownUpstream); !errors.Is(err, errorUnknownUpstream) {
+		t.Errorf("expected error %v, but got %v\n", errorUnknownUpstream, err)
+	}
+
+	// ending more connections than were recorded must not underflow
+	if err := tracker.ConnectionEnded(upstream1); !errors.Is(err, errorNoConnections) {
+		t.Errorf("expected error %v, but got %v\n", errorNoConnections, err)
+	}
+	if snapshot := tracker.Snapshot()[upstream1]; snapshot.ConnCount != 0 {
+		t.Errorf("expected ConnCount of 0, got %v\n", snapshot.ConnCount)
+	}
+}
+
+func TestUpstreamConnsWeights(t *testing.T) {
+	upstream1 := uuid.New()
+	upstream2 := uuid.New()
+
+	tracker := NewUpstreamConns([]uuid.UUID{upstream1, upstream2}, 0)
+	tracker.UpstreamAvailable(upstream1)
+	tracker.UpstreamAvailable(upstream2)
+
+	if err := tracker.SetUpstreamWeight(upstream1, 0); !errors.Is(err, errorInvalidWeight) {
+		t.Errorf("expected error %v, but got %v\n", errorInvalidWeight, err)
+	}
+	failIfNotNil(t, tracker.SetUpstreamWeight(upstream1, 3))
+
+	for i := 0; i < 8; i++ {
+		_, err := tracker.NextAvailableUpstream()
+		failIfNotNil(t, err)
+	}
+
+	snapshot := tracker.Snapshot()
+	if snapshot[upstream1].ConnCount != 6 || snapshot[upstream2].ConnCount != 2 {
+		t.Errorf("expected connections split 6:2 by weight, got %v:%v\n", snapshot[upstream1].ConnCount, snapshot[upstream2].ConnCount)
+	}
+
+	// reweighting an upstream reorders the upstreamPQ
+	failIfNotNil(t, tracker.SetUpstreamWeight(upstream1, 1))
+	id, err := tracker.NextAvailableUpstream()
+	failIfNotNil(t, err)
+	if id != upstream2 {
+		t.Errorf("expected upstream2 to be chosen after reweighting, got %v\n", id)
+	}
+}
+
+func TestUpstreamConnsRecordBytes(t *testing.T) {
+	upstream1 := uuid.New()
+	unknownUpstream := uuid.New()
+
+	tracker := NewUpstreamConns([]uuid.UUID{upstream1}, 0)
+	if err := tracker.RecordBytes(unknownUpstream, 1, 1); !errors.Is(err, errorUnknownUpstream) {
+		t.Errorf("expected error %v, but got %v\n", errorUnknownUpstream, err)
+	}
+
+	failIfNotNil(t, tracker.RecordBytes(upstream1, 10, 100))
+	failIfNotNil(t, tracker.RecordBytes(upstream1, 5, 0))
+
+	snapshot := tracker.Snapshot()[upstream1]
+	if snapshot.BytesSent != 15 || snapshot.BytesReceived != 100 {
+		t.Errorf("expected 15 bytes sent and 100 received, got %v and %v\n", snapshot.BytesSent, snapshot.BytesReceived)
+	}
+}
+
+func TestUpstreamConnsHooks(t *testing.T) {
+	upstream1 := uuid.New()
+
+	var records, ends []uuid.UUID
+	var rejects []error
+	var availability []bool
+	tracker := NewUpstreamConns([]uuid.UUID{upstream1}, 1)
+	tracker.SetHooks(UpstreamHooks{
+		OnRecord: func(id uuid.UUID) { records = append(records, id) },
+		OnEnd:    func(id uuid.UUID) { ends = append(ends, id) },
+		OnReject: func(err error) { rejects = append(rejects, err) },
+		OnAvailabilityChange: func(id uuid.UUID, available bool) {
+			// hooks are called once UpstreamConns is unlocked, so they may call back into it
+			if snapshot := tracker.Snapshot()[id]; snapshot.Available != available {
+				t.Errorf("expected Available of %v in hook, got %v\n", available, snapshot.Available)
+			}
+			availability = append(availability, available)
+		},
+	})
+
+	tracker.NextAvailableUpstream()
+	tracker.UpstreamAvailable(upstream1)
+	tracker.NextAvailableUpstream()
+	tracker.NextAvailableUpstream()
+	tracker.ConnectionEnded(upstream1)
+	tracker.DrainUpstream(upstream1)
+	tracker.UndrainUpstream(upstream1)
+	tracker.UpstreamUnavailable(upstream1)
+
+	if !reflect.DeepEqual([]uuid.UUID{upstream1}, records) {
+		t.Errorf("expected 1 record, got %v\n", records)
+	}
+	if !reflect.DeepEqual([]uuid.UUID{upstream1}, ends) {
+		t.Errorf("expected 1 end, got %v\n", ends)
+	}
+	if !reflect.DeepEqual([]error{errorNoAvailableUpstream, errorGroupAtCapacity}, rejects) {
+		t.Errorf("expected 2 rejects, got %v\n", rejects)
+	}
+	if !reflect.DeepEqual([]bool{true, false, true, false}, availability) {
+		t.Errorf("expected availability to change 4 times, got %v\n", availability)
+	}
+}
+
 func failIfNotNil(t *testing.T, err error) {
 	t.Helper()
 	if err != nil {